@@ -0,0 +1,250 @@
+package popi
+
+import (
+	"strconv"
+	"strings"
+)
+
+// mnemonics are the opcodes by their names.
+var mnemonics = func() map[string]opCode {
+	m := map[string]opCode{}
+	for op := opCode(opPushI); op <= lastOp; op++ {
+		m[op.String()] = op
+	}
+	return m
+}()
+
+// Assemble assembles the text of instructions into a program, which runs
+// the same as the program compiled from a source. There is an instruction
+// per line, its mnemonic as listed by Disassemble followed by operands
+// separated by spaces or commas:
+//
+//	pushi  2          ; constants are given by value
+//	seti   -1, 2.5    ; offsets of variables are relative to the frame
+//	getg   total      ; globals by name or index
+//	loop:
+//	jmpf   end        ; jump targets by label or address
+//	func   body, 1    ; functions by the label of the body and the arity
+//	call   1
+//	closure body, 1, 2 ; closures by the function and the number of cells
+//	end:
+//
+// Labels end with a colon and may precede an instruction on the same line,
+// comments start with a semicolon. The options may be nil. All errors
+// found are returned in ErrorList.
+func Assemble(src string, opts *Options) (*Program, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	a := &assembler{
+		g:      newCodeGen(append([]string(nil), opts.Globals...)...),
+		labels: map[string]int{},
+	}
+	for n, line := range strings.Split(src, "\n") {
+		a.assembleLine(n+1, line)
+	}
+	a.resolve()
+	prog, err := a.g.program()
+	if err != nil {
+		errs := err.(ErrorList)
+		errs.sort()
+		return nil, errs
+	}
+	prog.name = opts.Name
+	return prog, nil
+}
+
+type assembler struct {
+	g      *codeGen
+	labels map[string]int // addresses of the labels
+	fixups []fixup
+}
+
+// fixup is a use of a label before it is known to be defined.
+type fixup struct {
+	label asmToken
+	at    int   // position of the jump address
+	fn    *Func // or the function to set the address of
+}
+
+type asmToken struct {
+	text string
+	span Span
+}
+
+func (a *assembler) errorf(tok asmToken, format string, args ...interface{}) {
+	a.g.errs = append(a.g.errs, a.g.makeError(tok.span, format, args...))
+}
+
+func (a *assembler) assembleLine(n int, line string) {
+	toks, ok := a.split(n, line)
+	if !ok || len(toks) == 0 {
+		return
+	}
+	if label := toks[0]; strings.HasSuffix(label.text, ":") {
+		name := strings.TrimSuffix(label.text, ":")
+		if _, ok := a.labels[name]; ok {
+			a.errorf(label, "Duplicate label: %s", name)
+		} else if !isLabel(name) {
+			a.errorf(label, "Invalid label: %s", name)
+		}
+		a.labels[name] = a.g.code.Len()
+		if toks = toks[1:]; len(toks) == 0 {
+			return
+		}
+	}
+	mnemonic, args := toks[0], toks[1:]
+	op, ok := mnemonics[mnemonic.text]
+	if !ok {
+		var names []string
+		for op := opCode(opPushI); op <= lastOp; op++ {
+			names = append(names, op.String())
+		}
+		err := a.g.makeError(mnemonic.span, "Unknown instruction: %s", mnemonic.text).(*ParserError)
+		if name := suggest(mnemonic.text, names); name != "" {
+			err.hint = "did you mean `" + name + "`?"
+		}
+		a.g.errs = append(a.g.errs, err)
+		return
+	}
+	want := len(opArgs[op])
+	if op == opFunc || op == opClosure {
+		want++ // the arity follows the label
+	}
+	if len(args) != want {
+		a.errorf(mnemonic, "Wrong number of operands of %s: %d, %d expected", op, len(args), want)
+		return
+	}
+	a.g.setLine(n)
+	a.g.writeOp(op)
+	for k, kind := range opArgs[op] {
+		arg := args[k]
+		if k > 0 && want > len(opArgs[op]) {
+			arg = args[k+1]
+		}
+		switch kind {
+		case argConst:
+			a.constant(op, args[k:])
+		case argOffset:
+			n, err := strconv.Atoi(arg.text)
+			if err != nil {
+				a.errorf(arg, "Invalid offset: %s", arg.text)
+			}
+			a.g.writeVarint(n)
+		case argCount:
+			n, err := strconv.Atoi(arg.text)
+			if op == opGetGlobal && err != nil {
+				if n = a.g.findGlobal(arg.text); n >= 0 {
+					err = nil
+				}
+			}
+			if err != nil || n < 0 {
+				a.errorf(arg, "Invalid operand of %s: %s", op, arg.text)
+			}
+			a.g.writeUvarint(n)
+		case argAddr:
+			a.fixups = append(a.fixups, fixup{label: arg, at: a.g.code.Len()})
+			a.g.writeAddr(0)
+		}
+	}
+}
+
+// constant writes the constant given by the operands.
+func (a *assembler) constant(op opCode, args []asmToken) {
+	arg := args[0]
+	var val Value
+	switch op {
+	case opPushI, opSetI:
+		n, err := strconv.Atoi(arg.text)
+		if err != nil {
+			a.errorf(arg, "Invalid int: %s", arg.text)
+		}
+		val = IntValue(n)
+	case opPushF, opSetF:
+		n, err := strconv.ParseFloat(arg.text, 64)
+		if err != nil {
+			a.errorf(arg, "Invalid float: %s", arg.text)
+		}
+		val = FloatValue(n)
+	case opPushS, opField:
+		s, err := strconv.Unquote(arg.text)
+		if err != nil || !strings.HasPrefix(arg.text, `"`) {
+			a.errorf(arg, "Invalid string: %s", arg.text)
+		}
+		val = StringValue(s)
+	case opFunc, opClosure:
+		arity, err := strconv.Atoi(args[1].text)
+		if err != nil || arity < 0 {
+			a.errorf(args[1], "Invalid arity: %s", args[1].text)
+		}
+		f := &Func{0, arity}
+		a.fixups = append(a.fixups, fixup{label: arg, fn: f})
+		val = funcValue(f)
+	}
+	a.g.writeConst(val)
+}
+
+// resolve sets the addresses of the jumps and functions to their labels.
+func (a *assembler) resolve() {
+	for _, f := range a.fixups {
+		addr, ok := a.labels[f.label.text]
+		if !ok {
+			var err error
+			if addr, err = strconv.Atoi(f.label.text); err != nil || addr < 0 {
+				a.errorf(f.label, "Unknown label: %s", f.label.text)
+				continue
+			}
+		}
+		if f.fn != nil {
+			f.fn.addr = addr
+		} else {
+			a.g.patchAddr(f.at, addr)
+		}
+	}
+}
+
+// split splits the line into labels, mnemonics and operands, strings are
+// kept quoted.
+func (a *assembler) split(n int, line string) (toks []asmToken, ok bool) {
+	for i := 0; i < len(line); {
+		c := line[i]
+		switch {
+		case c == ';':
+			return toks, true
+		case c == ' ' || c == '\t' || c == '\r' || c == ',':
+			i++
+			continue
+		}
+		start := i
+		if c == '"' {
+			quoted, err := strconv.QuotedPrefix(line[i:])
+			if err != nil {
+				a.errorf(asmToken{span: asmSpan(n, start, len(line))}, "Unterminated string")
+				return nil, false
+			}
+			i += len(quoted)
+		} else {
+			for i < len(line) && !strings.ContainsRune(" \t\r,;\"", rune(line[i])) {
+				i++
+			}
+		}
+		toks = append(toks, asmToken{line[start:i], asmSpan(n, start, i)})
+	}
+	return toks, true
+}
+
+func asmSpan(line int, start int, end int) Span {
+	return Span{Pos{line, start + 1}, Pos{line, end + 1}}
+}
+
+func isLabel(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, c := range name {
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || i > 0 && c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,190 @@
+package popi
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func assemble(t *testing.T, s string) *Program {
+	prog, err := Assemble(s, &Options{Globals: []string{"total"}})
+	if err != nil {
+		t.Fatalf("%s: %v", t.Name(), err)
+	}
+	return prog
+}
+
+func TestAssemble(t *testing.T) {
+	prog := assemble(t, `
+	jmp    main           ; over the body
+twice:
+	get    0
+	pushi  2
+	mul
+	ret
+main:	func   twice, 1
+	dup
+	drop
+	get    0
+	getg   total
+	call   1
+	pushf  1.5
+	gt
+	jmpf   else
+	pushs  "big"
+	jmp    end
+else:	nil
+end:
+`)
+	compiled, err := Compile(`let twice = fn(x) { x * 2 }
+if twice(total) > 1.5 { "big" }`, &Options{Globals: []string{"total"}, NoPeephole: true})
+	if err != nil {
+		t.Fatalf("%s: %v", t.Name(), err)
+	}
+	if !reflect.DeepEqual(compiled.code, prog.code) {
+		t.Fatalf("%s: expected %v, actual %v", t.Name(), compiled.code, prog.code)
+	}
+	if !reflect.DeepEqual(compiled.consts, prog.consts) {
+		t.Fatalf("%s: expected %v, actual %v", t.Name(), compiled.consts, prog.consts)
+	}
+	vm := NewVM(prog)
+	vm.SetGlobal("total", 1)
+	res, err := vm.Run()
+	if err != nil {
+		t.Fatalf("%s: %v", t.Name(), err)
+	}
+	checkEqualString(t, "big", res.String())
+}
+
+func TestAssembleClosure(t *testing.T) {
+	prog := assemble(t, `
+	jmp    main
+adder:
+	get    0
+	cell
+	set    0
+	jmp    make
+add:
+	get    0
+	getu   0
+	add
+	ret
+make:
+	get    0
+	closure add, 1, 1
+	ret
+main:
+	func   adder, 1
+	dup
+	drop
+	get    0
+	pushi  2
+	call   1
+	pushi  3
+	call   1
+`)
+	compiled, err := Compile("let adder = fn(n) { fn(x) { x + n } }; adder(2)(3)", &Options{NoPeephole: true})
+	if err != nil {
+		t.Fatalf("%s: %v", t.Name(), err)
+	}
+	if !reflect.DeepEqual(compiled.code, prog.code) {
+		t.Fatalf("%s: expected %v, actual %v", t.Name(), compiled.code, prog.code)
+	}
+	if !reflect.DeepEqual(compiled.consts, prog.consts) {
+		t.Fatalf("%s: expected %v, actual %v", t.Name(), compiled.consts, prog.consts)
+	}
+	res, err := NewVM(prog).Run()
+	if err != nil {
+		t.Fatalf("%s: %v", t.Name(), err)
+	}
+	checkEqualInt(t, 5, res.Int())
+}
+
+func TestAssembleDeepStack(t *testing.T) {
+	// count(n) = if n == 0 { 0 } else { count(n - 1) + 1 }
+	i := newInterpreter(assemble(t, `
+	jmp    main
+count:
+	get    0
+	pushi  0
+	eq
+	jmpf   rec
+	pushi  0
+	ret
+rec:
+	func   count, 1
+	get    0
+	pushi  1
+	subi
+	call   1
+	pushi  1
+	addi
+	ret
+main:
+	func   count, 1
+	pushi  10000
+	call   1
+`))
+	if err := i.exec(); err != nil {
+		t.Fatalf("%s: %v", t.Name(), err)
+	}
+	checkEqualInt(t, 10000, i.popGo().(int))
+}
+
+func TestAssembleRuntimeErrors(t *testing.T) {
+	tests := []struct {
+		src string
+		msg string
+	}{
+		{"ret", "Return outside of function"},
+		{"pushi 1\nget -1", "Invalid variable offset: -1"},
+		{"jmp 100", "Invalid address: 100"},
+		{"func 100, 0", "Invalid address: 100"},
+		{"nil\ncall 1", "Stack underflow"},
+		{"func f, 2\npushi 1\ncall 1\nf: ret", "Wrong number of arguments: 1, 2 expected"},
+		{"nil\nclosure f, 0, 1\nf: ret", "Invalid cell"},
+		{"jmp main\nf: getu 1\nret\nmain: nil\ncell\nclosure f, 0, 1\ncall 0", "Invalid upvalue: 1"},
+		{"jmp main\nf: getu 0\nret\nmain: func f, 0\ncall 0", "Invalid upvalue: 0"},
+		{"pushi 1\ngetc 0", "Invalid cell"},
+		{"nil\ntcall 0", "Tail call outside of function"},
+		// the function drops the values of the caller
+		{"jmp main\nf: drop\ndrop\ndrop\nret\nmain: func f, 0\ncall 0", "Stack underflow"},
+	}
+	for _, test := range tests {
+		err := execError(t, assemble(t, test.src))
+		checkEqualString(t, test.msg, err.Msg())
+	}
+}
+
+func TestAssembleErrors(t *testing.T) {
+	tests := []struct {
+		src  string
+		msg  string
+		line int
+		hint string
+	}{
+		{"pushi 1\npush 2", "Unknown instruction: push", 2, "did you mean `pushi`?"},
+		{"pushi", "Wrong number of operands of pushi: 0, 1 expected", 1, ""},
+		{"dup 1", "Wrong number of operands of dup: 1, 0 expected", 1, ""},
+		{"pushi 1.5", "Invalid int: 1.5", 1, ""},
+		{"pushs abc", "Invalid string: abc", 1, ""},
+		{`pushs "abc`, "Unterminated string", 1, ""},
+		{"get x", "Invalid offset: x", 1, ""},
+		{"getg count", "Invalid operand of getg: count", 1, ""},
+		{"func f, x\nf: ret", "Invalid arity: x", 1, ""},
+		{"closure f, 0\nf: ret", "Wrong number of operands of closure: 2, 3 expected", 1, ""},
+		{"closure f, 0, x\nf: ret", "Invalid operand of closure: x", 1, ""},
+		{"jmp end", "Unknown label: end", 1, ""},
+		{"a: nil\n\na: nil", "Duplicate label: a", 3, ""},
+	}
+	for _, test := range tests {
+		_, err := Assemble(test.src, &Options{Globals: []string{"total"}})
+		var perr *ParserError
+		if !errors.As(err, &perr) {
+			t.Fatalf("%s: expected error for %q, actual %v", t.Name(), test.src, err)
+		}
+		checkEqualString(t, test.msg, perr.Msg())
+		checkEqualInt(t, test.line, perr.Line())
+		checkEqualString(t, test.hint, perr.Hint())
+	}
+}
@@ -0,0 +1,209 @@
+package popi
+
+// node is a node of the abstract syntax tree built by the parser. Every node
+// is an expression, i.e. it leaves a value when evaluated.
+type node interface {
+	Span() Span
+}
+
+type nodeSpan struct {
+	span Span
+}
+
+func (n *nodeSpan) Span() Span {
+	return n.span
+}
+
+// intLit is an integer literal.
+type intLit struct {
+	nodeSpan
+	Val int
+}
+
+// floatLit is a floating point literal.
+type floatLit struct {
+	nodeSpan
+	Val float64
+}
+
+// stringLit is a string literal with the escape sequences resolved.
+type stringLit struct {
+	nodeSpan
+	Val string
+}
+
+// boolLit is true or false.
+type boolLit struct {
+	nodeSpan
+	Val bool
+}
+
+// identifier is a variable reference or a name of a defined variable.
+type identifier struct {
+	nodeSpan
+	Name string
+}
+
+// binaryExpr is an arithmetic or comparison operation, Op is the token
+// of the operator.
+type binaryExpr struct {
+	nodeSpan
+	Op int
+	X  node
+	Y  node
+}
+
+// unaryExpr is a negation of a number or a bool, or the unary plus, Op is
+// the token of the operator.
+type unaryExpr struct {
+	nodeSpan
+	Op int
+	X  node
+}
+
+// assign is a declaration of a variable, Tok is the token of the keyword,
+// i.e. let, var or const, or an assignment to a declared variable, Tok is
+// 0 then. Its value is the value of the variable.
+type assign struct {
+	nodeSpan
+	Tok  int
+	Name *identifier
+	Val  node
+}
+
+// funcLit is a function definition.
+type funcLit struct {
+	nodeSpan
+	Params []*identifier
+	Body   *block
+}
+
+// callExpr is a function call.
+type callExpr struct {
+	nodeSpan
+	Fn   node
+	Args []node
+}
+
+// selectorExpr is a field or method of a host value, e.g. order.total.
+type selectorExpr struct {
+	nodeSpan
+	X   node
+	Sel *identifier
+}
+
+// indexExpr is an element of a host slice or map, e.g. items[0].
+type indexExpr struct {
+	nodeSpan
+	X     node
+	Index node
+}
+
+// block is a list of expressions, its value is the value of the last one.
+// The whole program is a block too.
+type block struct {
+	nodeSpan
+	List []node
+}
+
+// ifExpr is a conditional expression, Else is nil, *block or *ifExpr.
+type ifExpr struct {
+	nodeSpan
+	Cond node
+	Then *block
+	Else node
+}
+
+// whileExpr is a loop running while the condition holds.
+type whileExpr struct {
+	nodeSpan
+	Cond node
+	Body *block
+}
+
+// forExpr is a loop over the integer range From..To, To is excluded.
+type forExpr struct {
+	nodeSpan
+	Var  *identifier
+	From node
+	To   node
+	Body *block
+}
+
+// branchExpr is break or continue, Tok is the token of the keyword.
+type branchExpr struct {
+	nodeSpan
+	Tok int
+}
+
+// returnExpr returns from the function, Val is nil if the function returns
+// nil.
+type returnExpr struct {
+	nodeSpan
+	Val node
+}
+
+// badExpr is a placeholder of an expression which has a syntax error.
+type badExpr struct {
+	nodeSpan
+}
+
+// walk calls fn for the node and then for all its children in depth first
+// order, unless fn returns false.
+func walk(n node, fn func(node) bool) {
+	if n == nil || !fn(n) {
+		return
+	}
+	switch n := n.(type) {
+	case *binaryExpr:
+		walk(n.X, fn)
+		walk(n.Y, fn)
+	case *unaryExpr:
+		walk(n.X, fn)
+	case *assign:
+		walk(n.Name, fn)
+		walk(n.Val, fn)
+	case *funcLit:
+		for _, param := range n.Params {
+			walk(param, fn)
+		}
+		walk(n.Body, fn)
+	case *callExpr:
+		walk(n.Fn, fn)
+		for _, arg := range n.Args {
+			walk(arg, fn)
+		}
+	case *selectorExpr:
+		walk(n.X, fn)
+		walk(n.Sel, fn)
+	case *indexExpr:
+		walk(n.X, fn)
+		walk(n.Index, fn)
+	case *block:
+		for _, x := range n.List {
+			walk(x, fn)
+		}
+	case *ifExpr:
+		walk(n.Cond, fn)
+		walk(n.Then, fn)
+		if n.Else != nil {
+			walk(n.Else, fn)
+		}
+	case *whileExpr:
+		walk(n.Cond, fn)
+		walk(n.Body, fn)
+	case *forExpr:
+		walk(n.Var, fn)
+		walk(n.From, fn)
+		walk(n.To, fn)
+		walk(n.Body, fn)
+	case *returnExpr:
+		if n.Val != nil {
+			walk(n.Val, fn)
+		}
+	}
+}
+
+func spanOf(start node, end node) Span {
+	return Span{start.Span().Start, end.Span().End}
+}
@@ -0,0 +1,225 @@
+package popi
+
+import (
+	"fmt"
+	"reflect"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Object is a host value bound by reflection, i.e. a struct, a pointer,
+// a slice, an array or a map. Programs read its fields, call its methods
+// and index its elements.
+type Object struct {
+	val reflect.Value
+}
+
+func (o Object) String() string {
+	return fmt.Sprint(o.val.Interface())
+}
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// reflectValue converts a Go value of any type, named types are converted
+// by their kind.
+func reflectValue(v reflect.Value) (Value, error) {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return IntValue(int(v.Int())), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return IntValue(int(v.Uint())), nil
+	case reflect.Float32, reflect.Float64:
+		return FloatValue(v.Float()), nil
+	case reflect.Bool:
+		return BoolValue(v.Bool()), nil
+	case reflect.String:
+		return StringValue(v.String()), nil
+	case reflect.Interface:
+		if v.IsNil() {
+			return Value{}, nil
+		}
+		return reflectValue(v.Elem())
+	case reflect.Ptr, reflect.Map, reflect.Slice:
+		if v.IsNil() {
+			return Value{}, nil
+		}
+		return objectValue(Object{v}), nil
+	case reflect.Struct, reflect.Array:
+		return objectValue(Object{v}), nil
+	case reflect.Func:
+		if v.IsNil() {
+			return Value{}, nil
+		}
+		return nativeValue(reflectFunc(v.Type().String(), v)), nil
+	case reflect.Invalid:
+		return Value{}, nil
+	}
+	return Value{}, fmt.Errorf("Unsupported value: %s", v.Type())
+}
+
+// convertArg converts the value to the type of a parameter of a Go
+// function. Ints are converted to floats, but not the other way round.
+func convertArg(val Value, typ reflect.Type) (v reflect.Value, err error) {
+	arg := val.Interface()
+	if arg == nil {
+		switch typ.Kind() {
+		case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Interface, reflect.Func:
+			return reflect.Zero(typ), nil
+		}
+		return v, fmt.Errorf("Cannot use nil as %s", typ)
+	}
+	v = reflect.ValueOf(arg)
+	if v.Type().AssignableTo(typ) {
+		return
+	}
+	switch {
+	case isInt(v.Kind()) && (isInt(typ.Kind()) || isFloat(typ.Kind())),
+		isFloat(v.Kind()) && isFloat(typ.Kind()),
+		v.Kind() == reflect.String && typ.Kind() == reflect.String,
+		v.Kind() == reflect.Bool && typ.Kind() == reflect.Bool:
+		return v.Convert(typ), nil
+	}
+	return reflect.Value{}, fmt.Errorf("Cannot use %s as %s", v.Type(), typ)
+}
+
+func isInt(k reflect.Kind) bool {
+	return k >= reflect.Int && k <= reflect.Uintptr
+}
+
+func isFloat(k reflect.Kind) bool {
+	return k == reflect.Float32 || k == reflect.Float64
+}
+
+// reflectFunc makes the Go function callable from programs. An error
+// returned as the last result stops the program, the other result, if
+// there is any, is the value of the call.
+func reflectFunc(name string, fn reflect.Value) *Native {
+	typ := fn.Type()
+	arity := typ.NumIn()
+	if typ.IsVariadic() {
+		arity = -1
+	}
+	return &Native{name, arity, func(args []Value) (res Value, err error) {
+		if typ.IsVariadic() && len(args) < typ.NumIn()-1 {
+			return res, argCountError(len(args), typ.NumIn()-1)
+		}
+		in := make([]reflect.Value, len(args))
+		for i, arg := range args {
+			var t reflect.Type
+			if typ.IsVariadic() && i >= typ.NumIn()-1 {
+				t = typ.In(typ.NumIn() - 1).Elem()
+			} else {
+				t = typ.In(i)
+			}
+			if in[i], err = convertArg(arg, t); err != nil {
+				return res, fmt.Errorf("Argument %d: %w", i+1, err)
+			}
+		}
+		out := fn.Call(in)
+		if n := len(out); n > 0 && typ.Out(n-1) == errorType {
+			if !out[n-1].IsNil() {
+				return res, out[n-1].Interface().(error)
+			}
+			out = out[:n-1]
+		}
+		switch len(out) {
+		case 0:
+			return
+		case 1:
+			return reflectValue(out[0])
+		}
+		return res, fmt.Errorf("Unexpected number of results: %d", len(out))
+	}}
+}
+
+// field returns the field or the method of the object. The name is
+// matched against the popi tag of the field, its Go name, and its Go
+// name with the first letter in upper case, so order.total reads the
+// field Total. Maps with string keys are indexed by the name.
+func (o Object) field(name string) (Value, error) {
+	v := o.val
+	if m := method(v, name); m.IsValid() {
+		return nativeValue(reflectFunc(name, m)), nil
+	}
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return Value{}, fmt.Errorf("Nil pointer: %s", v.Type())
+		}
+		v = v.Elem()
+		if m := method(v, name); m.IsValid() {
+			return nativeValue(reflectFunc(name, m)), nil
+		}
+	}
+	switch v.Kind() {
+	case reflect.Struct:
+		exported := exportedName(name)
+		for _, f := range reflect.VisibleFields(v.Type()) {
+			if !f.IsExported() || f.Anonymous {
+				continue
+			}
+			if tag := f.Tag.Get("popi"); tag == name || tag == "" && (f.Name == name || f.Name == exported) {
+				return reflectValue(v.FieldByIndex(f.Index))
+			}
+		}
+	case reflect.Map:
+		if v.Type().Key().Kind() == reflect.String {
+			return o.index(StringValue(name))
+		}
+	}
+	return Value{}, fmt.Errorf("Unknown field: %s", name)
+}
+
+func method(v reflect.Value, name string) reflect.Value {
+	if m := v.MethodByName(name); m.IsValid() {
+		return m
+	}
+	return v.MethodByName(exportedName(name))
+}
+
+func exportedName(name string) string {
+	r, size := utf8.DecodeRuneInString(name)
+	return string(unicode.ToUpper(r)) + name[size:]
+}
+
+// index returns the element of the slice, array or map. A missing map key
+// is nil.
+func (o Object) index(key Value) (Value, error) {
+	v := o.val
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return Value{}, fmt.Errorf("Nil pointer: %s", v.Type())
+		}
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array:
+		if key.kind != KindInt {
+			return Value{}, typeError("int", key)
+		}
+		n := key.Int()
+		if n < 0 || n >= v.Len() {
+			return Value{}, fmt.Errorf("Index out of range: %d", n)
+		}
+		return reflectValue(v.Index(n))
+	case reflect.Map:
+		k, err := convertArg(key, v.Type().Key())
+		if err != nil {
+			return Value{}, err
+		}
+		return reflectValue(v.MapIndex(k))
+	}
+	return Value{}, fmt.Errorf("Cannot index %s", v.Type())
+}
+
+// length returns the number of elements of the slice, array or map.
+func (o Object) length() (n int, ok bool) {
+	v := o.val
+	if v.Kind() == reflect.Ptr && !v.IsNil() {
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return v.Len(), true
+	}
+	return
+}
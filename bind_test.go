@@ -0,0 +1,118 @@
+package popi
+
+import (
+	"errors"
+	"testing"
+)
+
+type testItem struct {
+	Name  string
+	Price float64
+	Qty   int
+}
+
+type testOrder struct {
+	ID       int64 `popi:"id"`
+	Customer string
+	Items    []testItem
+	Tags     map[string]int
+	secret   int
+}
+
+func (o *testOrder) Total() (total float64) {
+	for _, item := range o.Items {
+		total += item.Price * float64(item.Qty)
+	}
+	return
+}
+
+func (o *testOrder) Discount(pct float64) float64 {
+	return o.Total() * pct / 100
+}
+
+func (o *testOrder) Check(limit int) error {
+	if o.Total() > float64(limit) {
+		return errLimit
+	}
+	return nil
+}
+
+var errLimit = errors.New("Limit exceeded")
+
+func runBound(t *testing.T, src string) (Value, error) {
+	order := &testOrder{
+		ID:       7,
+		Customer: "ACME",
+		Items:    []testItem{{"bolt", 0.5, 10}, {"nut", 0.25, 20}},
+		Tags:     map[string]int{"priority": 2},
+		secret:   1,
+	}
+	prog, err := Compile(src, &Options{Globals: []string{"order"}})
+	if err != nil {
+		t.Fatalf("%s: %s: %v", t.Name(), src, err)
+	}
+	vm := NewVM(prog)
+	if err = vm.SetGlobal("order", order); err != nil {
+		t.Fatalf("%s: %v", t.Name(), err)
+	}
+	return vm.Run()
+}
+
+func TestBindValues(t *testing.T) {
+	tests := []struct {
+		src string
+		res interface{}
+	}{
+		{"order.id", 7},
+		{"order.customer", "ACME"},
+		{"order.Customer + \"!\"", "ACME!"},
+		{"order.total()", 10.0},
+		{"order.discount(10)", 1.0},
+		{"let f = fn(o) { o.items[1].name }; f(order)", "nut"},
+		{"len(order.items)", 2},
+		{`order.tags["priority"]`, 2},
+		{"order.tags.priority", 2},
+		{"order.tags.missing", nil},
+		{"order.check(100)", nil},
+	}
+	for _, test := range tests {
+		res, err := runBound(t, test.src)
+		if err != nil {
+			t.Fatalf("%s: %s: %v", t.Name(), test.src, err)
+		}
+		if res.Interface() != test.res {
+			t.Fatalf("%s: %s: expected %v, actual %v", t.Name(), test.src, test.res, res)
+		}
+	}
+	res, _ := runBound(t, "order.items[0]")
+	if item, ok := res.Interface().(testItem); !ok || item.Name != "bolt" {
+		t.Fatalf("%s: expected bolt item, actual %v", t.Name(), res)
+	}
+}
+
+func TestBindErrors(t *testing.T) {
+	tests := []struct {
+		src string
+		msg string
+	}{
+		{"order.secret", "Unknown field: secret"},
+		{"order.items[2]", "Index out of range: 2"},
+		{`order.items["a"]`, "Unexpected value: string, int expected"},
+		{"order.discount(true)", "discount: Argument 1: Cannot use bool as float64"},
+		{"order.discount()", "Wrong number of arguments: 0, 1 expected"},
+		{"order.check(1)", "check: Limit exceeded"},
+		{"order.id.x", "Unexpected value: int, object expected"},
+		{"order.customer[0]", "Unexpected value: string, object expected"},
+	}
+	for _, test := range tests {
+		_, err := runBound(t, test.src)
+		var rerr *RuntimeError
+		if !errors.As(err, &rerr) {
+			t.Fatalf("%s: %s: expected runtime error, actual %v", t.Name(), test.src, err)
+		}
+		checkEqualString(t, test.msg, rerr.Msg())
+	}
+	if _, err := runBound(t, "order.check(1)"); !errors.Is(err, errLimit) {
+		t.Fatalf("%s: expected wrapped error, actual %v", t.Name(), err)
+	}
+}
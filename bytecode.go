@@ -1,25 +1,25 @@
-package main
+package popi
 
 import "io"
 
-type ByteCode struct {
+type byteCode struct {
 	buf  []byte
 	addr int
 }
 
-func NewByteCode(buf []byte) *ByteCode {
-	return &ByteCode{buf, 0}
+func newByteCode(buf []byte) *byteCode {
+	return &byteCode{buf, 0}
 }
 
-func (b *ByteCode) Addr() int {
+func (b *byteCode) Addr() int {
 	return b.addr
 }
 
-func (b *ByteCode) SetAddr(addr int) {
+func (b *byteCode) SetAddr(addr int) {
 	b.addr = addr
 }
 
-func (b *ByteCode) Read(p []byte) (n int, err error) {
+func (b *byteCode) Read(p []byte) (n int, err error) {
 	n = len(b.buf) - b.addr
 	if n == 0 {
 		err = io.EOF
@@ -33,7 +33,7 @@ func (b *ByteCode) Read(p []byte) (n int, err error) {
 	return
 }
 
-func (b *ByteCode) ReadByte() (c byte, err error) {
+func (b *byteCode) ReadByte() (c byte, err error) {
 	n := len(b.buf) - b.addr
 	if n == 0 {
 		err = io.EOF
@@ -43,3 +43,57 @@ func (b *ByteCode) ReadByte() (c byte, err error) {
 	b.addr++
 	return
 }
+
+// ReadU16 reads a little endian uint16 operand, ok is false at the end of
+// the code.
+func (b *byteCode) ReadU16() (n int, ok bool) {
+	if len(b.buf)-b.addr < 2 {
+		return
+	}
+	n = int(b.buf[b.addr]) | int(b.buf[b.addr+1])<<8
+	b.addr += 2
+	return n, true
+}
+
+// ReadU32 reads a little endian uint32 operand.
+func (b *byteCode) ReadU32() (n int, ok bool) {
+	if len(b.buf)-b.addr < 4 {
+		return
+	}
+	p := b.buf[b.addr : b.addr+4]
+	n = int(uint32(p[0]) | uint32(p[1])<<8 | uint32(p[2])<<16 | uint32(p[3])<<24)
+	b.addr += 4
+	return n, true
+}
+
+// ReadUvarint reads an unsigned varint operand, ok is false at the end of
+// the code or if the varint overflows 64 bits.
+func (b *byteCode) ReadUvarint() (n uint64, ok bool) {
+	var shift uint
+	for i := b.addr; i < len(b.buf); i++ {
+		c := b.buf[i]
+		if shift == 63 && c > 1 {
+			return 0, false
+		}
+		n |= uint64(c&0x7f) << shift
+		if c < 0x80 {
+			b.addr = i + 1
+			return n, true
+		}
+		shift += 7
+	}
+	return 0, false
+}
+
+// ReadVarint reads a zigzag encoded signed varint operand.
+func (b *byteCode) ReadVarint() (n int64, ok bool) {
+	var u uint64
+	if u, ok = b.ReadUvarint(); !ok {
+		return
+	}
+	n = int64(u >> 1)
+	if u&1 != 0 {
+		n = ^n
+	}
+	return n, true
+}
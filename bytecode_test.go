@@ -0,0 +1,37 @@
+package popi
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestByteCodeVarint(t *testing.T) {
+	for _, n := range []int64{0, 1, -1, 63, -64, 64, 300, -300, 1 << 40, -1 << 62} {
+		buf := make([]byte, binary.MaxVarintLen64)
+		buf = buf[:binary.PutVarint(buf, n)]
+		b := newByteCode(buf)
+		if x, ok := b.ReadVarint(); !ok || x != n || b.Addr() != len(buf) {
+			t.Fatalf("%s: %d: unexpected %d, %v", t.Name(), n, x, ok)
+		}
+		if _, ok := newByteCode(buf[:len(buf)-1]).ReadVarint(); ok {
+			t.Fatalf("%s: %d: expected end of code", t.Name(), n)
+		}
+	}
+	over := []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x02}
+	if _, ok := newByteCode(over).ReadUvarint(); ok {
+		t.Fatalf("%s: expected overflow", t.Name())
+	}
+}
+
+func TestByteCodeFixed(t *testing.T) {
+	b := newByteCode([]byte{0x34, 0x12, 0x78, 0x56, 0x34, 0x12, 0xff})
+	if n, ok := b.ReadU16(); !ok || n != 0x1234 {
+		t.Fatalf("%s: unexpected u16 %x", t.Name(), n)
+	}
+	if n, ok := b.ReadU32(); !ok || n != 0x12345678 {
+		t.Fatalf("%s: unexpected u32 %x", t.Name(), n)
+	}
+	if _, ok := b.ReadU16(); ok {
+		t.Fatalf("%s: expected end of code", t.Name())
+	}
+}
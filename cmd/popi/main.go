@@ -0,0 +1,108 @@
+// Command popi runs a popi source file or a compiled program and prints
+// its value, compiles a source file to a .popc file, or lists the code of
+// a program.
+//
+//	popi file.popi
+//	popi file.popc
+//	popi build file.popi
+//	popi disasm file.popi
+//
+// The flag -nopeephole disables the peephole optimizer, e.g. to list the
+// code as generated.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/tomstejskal/popi"
+)
+
+const usage = `usage: popi [-nopeephole] file.popi
+       popi file.popc
+       popi [-nopeephole] build file.popi
+       popi [-nopeephole] disasm file.popi`
+
+var noPeephole = flag.Bool("nopeephole", false, "disable the peephole optimizer")
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, usage)
+	}
+	flag.Parse()
+	var (
+		name string
+		cmd  func(name string, src []byte) error
+		args = flag.Args()
+	)
+	switch {
+	case len(args) == 1:
+		name, cmd = args[0], run
+	case len(args) == 2 && args[0] == "build":
+		name, cmd = args[1], build
+	case len(args) == 2 && args[0] == "disasm":
+		name, cmd = args[1], disasm
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	src, err := ioutil.ReadFile(name)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err = cmd(name, src); err != nil {
+		if popi.IsCompiled(src) {
+			src = nil
+		}
+		fmt.Fprint(os.Stderr, popi.FormatError(name, string(src), err))
+		os.Exit(1)
+	}
+}
+
+// load compiles the source, or decodes it if it is a compiled program.
+func load(name string, src []byte) (*popi.Program, error) {
+	if popi.IsCompiled(src) {
+		return popi.Decode(src)
+	}
+	return popi.Compile(string(src), &popi.Options{Name: name, NoPeephole: *noPeephole})
+}
+
+func run(name string, src []byte) (err error) {
+	var prog *popi.Program
+	if prog, err = load(name, src); err != nil {
+		return
+	}
+	var res popi.Value
+	if res, err = popi.NewVM(prog).Run(); err != nil {
+		return
+	}
+	fmt.Println(res)
+	return
+}
+
+// build writes the compiled program next to the source, with the .popc
+// extension.
+func build(name string, src []byte) (err error) {
+	var prog *popi.Program
+	if prog, err = popi.Compile(string(src), &popi.Options{Name: name, NoPeephole: *noPeephole}); err != nil {
+		return
+	}
+	var data []byte
+	if data, err = popi.Encode(prog); err != nil {
+		return
+	}
+	return ioutil.WriteFile(strings.TrimSuffix(name, ".popi")+".popc", data, 0666)
+}
+
+// disasm lists the code of the source or of the compiled program.
+func disasm(name string, src []byte) (err error) {
+	var prog *popi.Program
+	if prog, err = load(name, src); err != nil {
+		return
+	}
+	return popi.Disassemble(os.Stdout, prog)
+}
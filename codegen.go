@@ -0,0 +1,926 @@
+package popi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// codeGen generates the bytecode of a syntax tree built by the parser.
+type codeGen struct {
+	code     *bytes.Buffer
+	consts   []Value
+	index    map[constKey]int // indexes of the constants in consts
+	lines    []lineInfo
+	scope    *scope
+	loop     *loop
+	fn       *function
+	captured map[*identifier]bool // idents of the variables kept in cells
+	assigned map[*identifier]bool // idents of the variables assigned
+	globals  []string
+	errs     ErrorList
+}
+
+// constKey identifies a constant, so equal constants share the index.
+type constKey struct {
+	kind Kind
+	num  uint64
+	str  string
+}
+
+// maxConsts is the number of constants addressable by the u16 operands.
+const maxConsts = 1 << 16
+
+type scope struct {
+	item      *item
+	stackSize int
+	next      *scope
+}
+
+const (
+	itemVar = iota
+	itemParam
+	itemConst
+)
+
+type itemTyp byte
+
+// loop describes the innermost loop being generated, so break and
+// continue know where to jump and how many values to drop from the stack.
+type loop struct {
+	base      int   // stack size at the start of each iteration
+	breaks    []int // jumps to the end of the loop
+	continues []int // jumps to the next iteration
+	next      *loop
+}
+
+// function describes the function being generated. The variables of the
+// enclosing functions it uses are its upvalues, their cells are captured
+// by the closure created at its end.
+type function struct {
+	upvals []*item
+	next   *function
+}
+
+type item struct {
+	typ   itemTyp
+	vtyp  valTyp
+	ident string
+	val   int
+	cell  bool      // the slot holds the cell of a captured variable
+	fn    *function // the function defining the variable
+	next  *item
+}
+
+// valTyp is the type of a value known at compile time, used to choose
+// typed opcodes.
+type valTyp byte
+
+const (
+	typAny valTyp = iota
+	typInt
+	typFloat
+	typBool
+	typNil
+	typString
+)
+
+func (t valTyp) isNum() bool {
+	return t == typInt || t == typFloat
+}
+
+// newCodeGen returns a code generator for programs which can use the
+// globals, their values are looked up by the index in the list.
+func newCodeGen(globals ...string) *codeGen {
+	return &codeGen{&bytes.Buffer{}, nil, map[constKey]int{}, nil, &scope{}, nil, &function{}, nil, nil, globals, nil}
+}
+
+// Generate generates the code of the program. Errors do not stop the
+// generation, all of them are returned in ErrorList. Constant
+// subexpressions of the tree are folded in place.
+func (g *codeGen) Generate(prog *block) (*Program, error) {
+	fold(prog)
+	g.captured, g.assigned = resolveVars(prog)
+	g.genList(prog.List, false)
+	return g.program()
+}
+
+// program returns the generated program, or the errors found.
+func (g *codeGen) program() (*Program, error) {
+	if len(g.consts) > maxConsts {
+		g.errs = append(g.errs, fmt.Errorf("Too many constants: %d, %d allowed", len(g.consts), maxConsts))
+	}
+	if len(g.errs) > 0 {
+		return nil, g.errs
+	}
+	return &Program{code: g.code.Bytes(), consts: g.consts, globals: g.globals, lines: g.lines}, nil
+}
+
+// genList generates an expression list, only the value of the last
+// expression is left on the stack. The last expression is in tail position
+// if the list is.
+func (g *codeGen) genList(list []node, tail bool) (typ valTyp) {
+	for i, n := range list {
+		if i > 0 {
+			g.writeOp(opDrop)
+		}
+		if tail && i == len(list)-1 {
+			typ = g.genTail(n)
+		} else {
+			typ = g.gen(n)
+		}
+	}
+	return
+}
+
+// genTail generates the expression in tail position of a function, i.e.
+// its value is returned by the function. A call in tail position replaces
+// the call of the function, so recursion in tail position does not grow
+// the call stack.
+func (g *codeGen) genTail(n node) valTyp {
+	switch n := n.(type) {
+	case *callExpr:
+		g.markLine(n)
+		return g.genCall(n, true)
+	case *block:
+		g.markLine(n)
+		return g.genBlock(n, true)
+	case *ifExpr:
+		g.markLine(n)
+		return g.genIf(n, true)
+	}
+	return g.gen(n)
+}
+
+// gen generates the code of the expression and returns the type of its
+// value.
+func (g *codeGen) gen(n node) valTyp {
+	g.markLine(n)
+	switch n := n.(type) {
+	case *intLit:
+		g.writeOp(opPushI)
+		g.writeConst(IntValue(n.Val))
+		return typInt
+	case *floatLit:
+		g.writeOp(opPushF)
+		g.writeConst(FloatValue(n.Val))
+		return typFloat
+	case *stringLit:
+		g.writeOp(opPushS)
+		g.writeConst(StringValue(n.Val))
+		return typString
+	case *boolLit:
+		if n.Val {
+			g.writeOp(opTrue)
+		} else {
+			g.writeOp(opFalse)
+		}
+		return typBool
+	case *identifier:
+		item := g.findItem(n.Name)
+		if item == nil {
+			if idx := g.findGlobal(n.Name); idx >= 0 {
+				g.writeOp(opGetGlobal)
+				g.writeUvarint(idx)
+				return typAny
+			}
+			g.errs = append(g.errs, g.unknownVar(n))
+			g.writeOp(opNil)
+			return typAny
+		}
+		g.writeGet(item)
+		return item.vtyp
+	case *binaryExpr:
+		return g.genBinary(n)
+	case *unaryExpr:
+		return g.genUnary(n)
+	case *assign:
+		if n.Tok == 0 {
+			return g.genAssign(n)
+		}
+		return g.genDecl(n)
+	case *funcLit:
+		g.genFunc(n)
+		return typAny
+	case *callExpr:
+		return g.genCall(n, false)
+	case *selectorExpr:
+		g.gen(n.X)
+		g.writeOp(opField)
+		g.writeConst(StringValue(n.Sel.Name))
+		return typAny
+	case *indexExpr:
+		g.gen(n.X)
+		g.gen(n.Index)
+		g.writeOp(opIndex)
+		return typAny
+	case *block:
+		return g.genBlock(n, false)
+	case *ifExpr:
+		return g.genIf(n, false)
+	case *whileExpr:
+		g.genWhile(n)
+		return typAny
+	case *forExpr:
+		g.genFor(n)
+		return typAny
+	case *branchExpr:
+		if g.loop == nil {
+			g.errs = append(g.errs, g.makeError(n.span, "Not in a loop: %s", token{id: n.Tok}))
+			g.writeOp(opNil)
+			return typAny
+		}
+		at := g.writeLoopJump()
+		if n.Tok == tokBreak {
+			g.loop.breaks = append(g.loop.breaks, at)
+		} else {
+			g.loop.continues = append(g.loop.continues, at)
+		}
+		return typAny
+	case *returnExpr:
+		stackSize := g.scope.stackSize
+		if g.fn.next == nil {
+			g.errs = append(g.errs, g.makeError(n.span, "Return outside of function"))
+		}
+		if n.Val != nil {
+			g.genTail(n.Val)
+		} else {
+			g.writeOp(opNil)
+		}
+		g.markLine(n)
+		g.writeOp(opRet)
+		// the code following is not reached, return is an expression
+		// like break
+		g.scope.stackSize = stackSize + 1
+		return typAny
+	case *badExpr:
+		// the code is not used, only the stack size must be kept right
+		g.writeOp(opNil)
+		return typAny
+	}
+	panic(fmt.Errorf("Unexpected node: %T", n))
+}
+
+// compareOps maps comparison tokens to their opcodes.
+var compareOps = map[int]opCode{
+	tokEqual:        opEq,
+	tokNotEqual:     opNe,
+	tokLess:         opLt,
+	tokLessEqual:    opLe,
+	tokGreater:      opGt,
+	tokGreaterEqual: opGe,
+}
+
+// genBinary generates a comparison or an arithmetic operation. Identities,
+// e.g. x * 1, are generated as the operand only, if the operand is known to
+// be of the type of the literal, so the operation could not fail.
+func (g *codeGen) genBinary(n *binaryExpr) valTyp {
+	if typ, ok := identity(n.Op, n.X, true); ok && g.staticType(n.Y) == typ {
+		return g.gen(n.Y)
+	}
+	x := g.gen(n.X)
+	if typ, ok := identity(n.Op, n.Y, false); ok && x == typ {
+		return x
+	}
+	y := g.gen(n.Y)
+	g.markLine(n)
+	if op, ok := compareOps[n.Op]; ok {
+		g.writeOp(op)
+		return typBool
+	}
+	return g.writeArith(n.Op, x, y)
+}
+
+// unaryOps maps unary tokens to their opcodes.
+var unaryOps = map[int]opCode{
+	tokSub: opNeg,
+	tokAdd: opPos,
+	tokNot: opNot,
+}
+
+// genUnary generates the unary operation. Negation keeps the type of the
+// number, the unary plus only checks the operand is a number, so it is left
+// out when the number is known at compile time.
+func (g *codeGen) genUnary(n *unaryExpr) valTyp {
+	x := g.gen(n.X)
+	op := unaryOps[n.Op]
+	if op == opPos && x.isNum() {
+		return x
+	}
+	g.markLine(n)
+	g.writeOp(op)
+	switch {
+	case op == opNot:
+		return typBool
+	case x.isNum():
+		return x
+	}
+	return typAny
+}
+
+// identity returns the type of the operand the literal is the identity
+// element of the operation for, i.e. 0 of addition and subtraction and 1 of
+// multiplication and division, the latter ones on the right side only.
+// Float addition of 0 is not an identity, as it turns -0 to 0.
+func identity(op int, lit node, left bool) (typ valTyp, ok bool) {
+	var n float64
+	switch lit := lit.(type) {
+	case *intLit:
+		n, typ = float64(lit.Val), typInt
+	case *floatLit:
+		n, typ = lit.Val, typFloat
+	default:
+		return
+	}
+	switch {
+	case op == tokAdd && typ == typInt, op == tokSub && !left:
+		ok = n == 0
+	case op == tokMul, op == tokDiv && !left:
+		ok = n == 1
+	}
+	return
+}
+
+// staticType returns the type of the expression known before its code is
+// generated, i.e. the type of a literal or a variable.
+func (g *codeGen) staticType(n node) valTyp {
+	switch n := n.(type) {
+	case *intLit:
+		return typInt
+	case *floatLit:
+		return typFloat
+	case *identifier:
+		if item := g.findItem(n.Name); item != nil {
+			return item.vtyp
+		}
+	}
+	return typAny
+}
+
+// arithOps maps arithmetic tokens to their int, float and generic opcodes.
+var arithOps = map[int][3]opCode{
+	tokAdd: {opAddI, opAddF, opAdd},
+	tokSub: {opSubI, opSubF, opSub},
+	tokMul: {opMulI, opMulF, opMul},
+	tokDiv: {opDivI, opDivF, opDiv},
+	tokMod: {opModI, opModF, opMod},
+	tokPow: {opPowI, opPowF, opPow},
+}
+
+// writeArith writes the arithmetic operation of the token. Typed opcodes
+// are used when both operands are known to be ints or floats, otherwise
+// the generic opcode checks the operands at run time and promotes int to
+// float when they are mixed.
+func (g *codeGen) writeArith(tok int, x valTyp, y valTyp) valTyp {
+	ops := arithOps[tok]
+	switch {
+	case x == typInt && y == typInt:
+		g.writeOp(ops[0])
+		return typInt
+	case x == typFloat && y == typFloat:
+		g.writeOp(ops[1])
+		return typFloat
+	}
+	g.writeOp(ops[2])
+	switch {
+	case x.isNum() && y.isNum():
+		return typFloat
+	case tok == tokAdd && x == typString && y == typString:
+		return typString
+	}
+	return typAny
+}
+
+// genCall generates a function call. The callee is pushed first and the
+// arguments above it. The builtin len is used unless there is a variable
+// of the same name. A call in tail position is a tail call.
+func (g *codeGen) genCall(n *callExpr, tail bool) valTyp {
+	if ident, ok := n.Fn.(*identifier); ok && ident.Name == "len" && g.findItem("len") == nil {
+		if len(n.Args) != 1 {
+			g.errs = append(g.errs, g.makeError(n.span, "Wrong number of arguments of len: %d, 1 expected", len(n.Args)))
+			g.writeOp(opNil)
+			return typAny
+		}
+		g.gen(n.Args[0])
+		g.writeOp(opLen)
+		return typInt
+	}
+	g.gen(n.Fn)
+	for _, arg := range n.Args {
+		g.gen(arg)
+	}
+	g.markLine(n)
+	if tail {
+		g.writeOp(opTailCall)
+	} else {
+		g.writeOp(opCall)
+	}
+	g.writeUvarint(len(n.Args))
+	g.scope.stackSize -= len(n.Args) // callee and arguments are replaced by the result
+	return typAny
+}
+
+// genFunc generates a function definition. The body is skipped by a jump
+// and only the function, i.e. its address and arity, is left on the stack.
+// A function using variables of the enclosing functions is left as a
+// closure of their cells.
+func (g *codeGen) genFunc(n *funcLit) {
+	jmp := g.writeJump(opJmp)
+	addr := g.code.Len()
+	g.pushScope(&scope{})
+	g.fn = &function{next: g.fn}
+	loop := g.loop
+	g.loop = nil
+	for i, param := range n.Params {
+		item := g.newParam(param.Name, i)
+		g.pushItem(item)
+		if g.captured[param] {
+			g.writeOp(opGet)
+			g.writeVarint(item.val)
+			g.writeOp(opCell)
+			g.writeOp(opSet)
+			g.writeVarint(item.val)
+			item.cell = true
+		}
+	}
+	g.genList(n.Body.List, true)
+	g.writeOp(opRet)
+	g.loop = loop
+	fn := g.fn
+	g.fn = fn.next
+	g.popScope()
+	g.patchJump(jmp)
+	f := funcValue(&Func{addr, len(n.Params)})
+	if len(fn.upvals) == 0 {
+		g.writeOp(opFunc)
+		g.writeConst(f)
+		return
+	}
+	for _, item := range fn.upvals {
+		if item.fn == g.fn {
+			g.writeOp(opGet)
+			g.writeVarint(item.val)
+		} else {
+			g.writeOp(opRefUpval)
+			g.writeUvarint(g.upval(item))
+		}
+	}
+	g.writeOp(opClosure)
+	g.writeConst(f)
+	g.writeUvarint(len(fn.upvals))
+	g.scope.stackSize -= len(fn.upvals) // the cells are replaced by the closure
+}
+
+// genDecl generates a declaration of a variable, the value is left on the
+// stack in a new slot of the variable. The type of the variable is not
+// known if the variable is assigned later.
+func (g *codeGen) genDecl(n *assign) valTyp {
+	if fn, ok := n.Val.(*funcLit); ok && g.captured[n.Name] {
+		g.genRecFunc(n, fn)
+		return typAny
+	}
+	typ := g.gen(n.Val)
+	item := g.newVar(n.Name.Name, typ)
+	g.declare(item, n)
+	if item.cell {
+		g.writeOp(opCell)
+		g.writeGet(item)
+	} else {
+		g.writeOp(opDup)
+	}
+	return typ
+}
+
+// genRecFunc generates the declaration of a function which refers to the
+// variable declared, i.e. calls itself. The variable is declared before
+// the function, so the closure captures its cell, and set to the closure.
+func (g *codeGen) genRecFunc(decl *assign, n *funcLit) {
+	g.writeOp(opNil)
+	g.writeOp(opCell)
+	item := g.declare(g.newVar(decl.Name.Name, typAny), decl)
+	g.genFunc(n)
+	g.writeSet(item)
+	g.writeGet(item)
+}
+
+// declare adds the variable of the declaration to the scope.
+func (g *codeGen) declare(it *item, decl *assign) *item {
+	if decl.Tok == tokConst {
+		it.typ = itemConst
+	}
+	if g.assigned[decl.Name] {
+		it.vtyp = typAny
+	}
+	it.cell = g.captured[decl.Name]
+	g.pushItem(it)
+	return it
+}
+
+// genAssign generates an assignment to a declared variable, the value is
+// set to its slot and left on the stack too.
+func (g *codeGen) genAssign(n *assign) valTyp {
+	item := g.findItem(n.Name.Name)
+	switch {
+	case item == nil:
+		g.errs = append(g.errs, g.undeclaredVar(n.Name))
+		return g.gen(n.Val)
+	case item.typ == itemConst:
+		g.errs = append(g.errs, g.makeError(n.Name.span, "Cannot assign to constant: %s", n.Name.Name))
+		return g.gen(n.Val)
+	}
+	if lit, ok := n.Val.(*intLit); ok && item.fn == g.fn && !item.cell {
+		g.writeOp(opSetI)
+		g.writeVarint(item.val)
+		g.writeConst(IntValue(lit.Val))
+		g.writeGet(item)
+		return typInt
+	}
+	if lit, ok := n.Val.(*floatLit); ok && item.fn == g.fn && !item.cell {
+		g.writeOp(opSetF)
+		g.writeVarint(item.val)
+		g.writeConst(FloatValue(lit.Val))
+		g.writeGet(item)
+		return typFloat
+	}
+	typ := g.gen(n.Val)
+	g.writeOp(opDup)
+	g.writeSet(item)
+	return typ
+}
+
+// upval returns the index of the upvalue of the variable of an enclosing
+// function in the function being generated.
+func (g *codeGen) upval(it *item) int {
+	for k, upval := range g.fn.upvals {
+		if upval == it {
+			return k
+		}
+	}
+	g.fn.upvals = append(g.fn.upvals, it)
+	return len(g.fn.upvals) - 1
+}
+
+// writeGet pushes the value of the variable.
+func (g *codeGen) writeGet(it *item) {
+	switch {
+	case it.fn != g.fn:
+		g.writeOp(opGetUpval)
+		g.writeUvarint(g.upval(it))
+	case it.cell:
+		g.writeOp(opGetCell)
+		g.writeVarint(it.val)
+	default:
+		g.writeOp(opGet)
+		g.writeVarint(it.val)
+	}
+}
+
+// writeSet pops the value of the variable.
+func (g *codeGen) writeSet(it *item) {
+	switch {
+	case it.fn != g.fn:
+		g.writeOp(opSetUpval)
+		g.writeUvarint(g.upval(it))
+	case it.cell:
+		g.writeOp(opSetCell)
+		g.writeVarint(it.val)
+	default:
+		g.writeOp(opSet)
+		g.writeVarint(it.val)
+	}
+}
+
+// genIf generates an if expression. The else branch is optional, nil is
+// the value of an if without else when the condition does not hold.
+func (g *codeGen) genIf(n *ifExpr, tail bool) valTyp {
+	g.gen(n.Cond)
+	jmpElse := g.writeJump(opJmpF)
+	typ := g.genBlock(n.Then, tail)
+	jmpEnd := g.writeJump(opJmp)
+	g.scope.stackSize-- // only one of the branches leaves its value
+	g.patchJump(jmpElse)
+	var elseTyp valTyp
+	if n.Else != nil && tail {
+		elseTyp = g.genTail(n.Else)
+	} else if n.Else != nil {
+		elseTyp = g.gen(n.Else)
+	} else {
+		g.writeOp(opNil)
+		elseTyp = typNil
+	}
+	g.patchJump(jmpEnd)
+	if elseTyp != typ {
+		return typAny
+	}
+	return typ
+}
+
+// genWhile generates a while loop. The value of a loop is the value of
+// the body in its last completed iteration, or nil if there was none.
+func (g *codeGen) genWhile(n *whileExpr) {
+	g.writeOp(opNil)
+	result := g.scope.stackSize - 1
+	start := g.code.Len()
+	g.gen(n.Cond)
+	jmpEnd := g.writeJump(opJmpF)
+	g.pushLoop()
+	g.genLoopBody(n.Body, result)
+	loop := g.popLoop()
+	g.writeOp(opJmp)
+	g.writeAddr(start)
+	for _, at := range loop.continues {
+		g.patchAddr(at, start)
+	}
+	g.patchJump(jmpEnd)
+	for _, at := range loop.breaks {
+		g.patchJump(at)
+	}
+}
+
+// genFor generates a loop over the integer range. The counter and the
+// limit are kept on the stack above the result. A captured counter gets a
+// new cell in every iteration, so each closure created in the body keeps
+// the value of its iteration.
+func (g *codeGen) genFor(n *forExpr) {
+	g.writeOp(opNil)
+	result := g.scope.stackSize - 1
+	base := g.scope.stackSize
+	g.pushScope(&scope{stackSize: base})
+	counter := g.newVar(n.Var.Name, g.gen(n.From))
+	if g.assigned[n.Var] {
+		counter.vtyp = typAny
+	}
+	g.pushItem(counter)
+	if g.captured[n.Var] {
+		g.writeOp(opCell)
+		counter.cell = true
+	}
+	limit := g.newVar("", g.gen(n.To))
+	g.pushItem(limit)
+	start := g.code.Len()
+	g.writeGet(counter)
+	g.writeOp(opGet)
+	g.writeVarint(limit.val)
+	g.writeOp(opLt)
+	jmpEnd := g.writeJump(opJmpF)
+	g.pushLoop()
+	g.genLoopBody(n.Body, result)
+	loop := g.popLoop()
+	for _, at := range loop.continues {
+		g.patchJump(at)
+	}
+	if counter.cell {
+		g.writeGet(counter)
+		g.writeOp(opCell)
+		g.writeOp(opSet)
+		g.writeVarint(counter.val)
+	}
+	g.writeGet(counter)
+	g.writeOp(opPushI)
+	g.writeConst(IntValue(1))
+	g.writeArith(tokAdd, counter.vtyp, typInt)
+	g.writeSet(counter)
+	g.writeOp(opJmp)
+	g.writeAddr(start)
+	g.patchJump(jmpEnd)
+	for _, at := range loop.breaks {
+		g.patchJump(at)
+	}
+	g.writeOp(opDrop)
+	g.writeOp(opDrop)
+	g.popScope()
+	g.scope.stackSize = base
+}
+
+// genLoopBody generates the body of a loop and stores its value in the
+// result slot.
+func (g *codeGen) genLoopBody(body *block, result int) {
+	g.genBlock(body, false)
+	g.writeOp(opSet)
+	g.writeVarint(result)
+}
+
+// writeLoopJump drops everything pushed since the start of the iteration
+// of the innermost loop and writes a jump to be patched by the loop.
+// The stack size is restored as break and continue are expressions too.
+func (g *codeGen) writeLoopJump() (at int) {
+	stackSize := g.scope.stackSize
+	for n := stackSize - g.loop.base; n > 0; n-- {
+		g.writeOp(opDrop)
+	}
+	at = g.writeJump(opJmp)
+	g.scope.stackSize = stackSize + 1
+	return
+}
+
+func (g *codeGen) pushLoop() {
+	g.loop = &loop{base: g.scope.stackSize, next: g.loop}
+}
+
+func (g *codeGen) popLoop() (l *loop) {
+	l = g.loop
+	g.loop = l.next
+	return
+}
+
+// genBlock generates a block. Variables defined in the block are dropped
+// at its end, only the value of the block is left.
+func (g *codeGen) genBlock(n *block, tail bool) (typ valTyp) {
+	base := g.scope.stackSize
+	g.pushScope(&scope{stackSize: base})
+	typ = g.genList(n.List, tail)
+	for n := g.scope.stackSize - base - 1; n > 0; n-- {
+		g.writeOp(opSwap)
+		g.writeOp(opDrop)
+	}
+	g.popScope()
+	g.scope.stackSize++
+	return
+}
+
+func (g *codeGen) makeError(span Span, format string, a ...interface{}) error {
+	return &ParserError{span, fmt.Sprintf(format, a...), ""}
+}
+
+// unknownVar returns an error for the ident, with a hint naming the most
+// similar variable in scope.
+func (g *codeGen) unknownVar(ident *identifier) error {
+	names := append([]string{"len"}, g.globals...)
+	for scope := g.scope; scope != nil; scope = scope.next {
+		for item := scope.item; item != nil; item = item.next {
+			// hidden variables, e.g. the limit of a for loop, have no name
+			if item.ident != "" {
+				names = append(names, item.ident)
+			}
+		}
+	}
+	err := &ParserError{ident.span, fmt.Sprintf("Unknown variable: %s", ident.Name), ""}
+	if name := suggest(ident.Name, names); name != "" {
+		err.hint = fmt.Sprintf("did you mean `%s`?", name)
+	}
+	return err
+}
+
+// undeclaredVar returns an error for the assignment to the ident, which is
+// not a variable in scope.
+func (g *codeGen) undeclaredVar(ident *identifier) error {
+	if g.findGlobal(ident.Name) >= 0 {
+		return g.makeError(ident.span, "Cannot assign to global: %s", ident.Name)
+	}
+	err := g.unknownVar(ident).(*ParserError)
+	err.msg = fmt.Sprintf("Undeclared variable: %s", ident.Name)
+	if err.hint == "" {
+		err.hint = fmt.Sprintf("declare it with `let %s = ...`", ident.Name)
+	}
+	return err
+}
+
+func (g *codeGen) pushItem(it *item) {
+	it.next = g.scope.item
+	g.scope.item = it
+}
+
+func (g *codeGen) findItem(ident string) *item {
+	for scope := g.scope; scope != nil; scope = scope.next {
+		for item := scope.item; item != nil; item = item.next {
+			if item.ident == ident {
+				return item
+			}
+		}
+	}
+	return nil
+}
+
+func (g *codeGen) findGlobal(ident string) int {
+	for i, name := range g.globals {
+		if name == ident {
+			return i
+		}
+	}
+	return -1
+}
+
+func (g *codeGen) pushScope(s *scope) {
+	s.next = g.scope
+	g.scope = s
+}
+
+func (g *codeGen) popScope() (s *scope) {
+	s = g.scope
+	g.scope = s.next
+	s.next = nil
+	return
+}
+
+// writeOp writes the opcode and tracks the stack size by its effect in
+// opStack.
+func (g *codeGen) writeOp(op opCode) (err error) {
+	if err = g.code.WriteByte(byte(op)); err != nil {
+		return
+	}
+	effect, ok := opStack[op]
+	if !ok {
+		panic(fmt.Errorf("Unexpected opcode: %s", op))
+	}
+	g.scope.stackSize += effect.push - effect.pop
+	return
+}
+
+// markLine records the span of the node for the code written next.
+func (g *codeGen) markLine(n node) {
+	g.setSpan(n.Span())
+}
+
+// setLine records the line for the code written next, the columns are not
+// known.
+func (g *codeGen) setLine(line int) {
+	g.setSpan(Span{Pos{line, 0}, Pos{line, 0}})
+}
+
+// setSpan records the span for the code written next, unless it is the
+// same as the span of the preceding code.
+func (g *codeGen) setSpan(span Span) {
+	if span.Start.Line == 0 {
+		return
+	}
+	addr := g.code.Len()
+	if k := len(g.lines); k > 0 {
+		last := &g.lines[k-1]
+		if last.span == span {
+			return
+		}
+		if last.addr == addr {
+			last.span = span
+			return
+		}
+	}
+	g.lines = append(g.lines, lineInfo{addr, span})
+}
+
+// writeConst writes the u16 index of the constant, which is added to the
+// constant pool unless it is there already. Functions are never shared.
+func (g *codeGen) writeConst(val Value) {
+	idx := len(g.consts)
+	switch val.kind {
+	case KindFunc:
+		g.consts = append(g.consts, val)
+	default:
+		key := constKey{kind: val.kind, num: val.num}
+		if val.kind == KindString {
+			key.str = val.ref.(string)
+		}
+		if i, ok := g.index[key]; ok {
+			idx = i
+		} else {
+			g.index[key] = idx
+			g.consts = append(g.consts, val)
+		}
+	}
+	g.code.WriteByte(byte(idx))
+	g.code.WriteByte(byte(idx >> 8))
+}
+
+func (g *codeGen) writeUvarint(n int) {
+	var buf [binary.MaxVarintLen64]byte
+	g.code.Write(buf[:binary.PutUvarint(buf[:], uint64(n))])
+}
+
+func (g *codeGen) writeVarint(n int) {
+	var buf [binary.MaxVarintLen64]byte
+	g.code.Write(buf[:binary.PutVarint(buf[:], int64(n))])
+}
+
+// writeAddr writes a jump address as u32, so it can be patched in place.
+func (g *codeGen) writeAddr(addr int) {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], uint32(addr))
+	g.code.Write(buf[:])
+}
+
+func (g *codeGen) patchAddr(at int, addr int) {
+	binary.LittleEndian.PutUint32(g.code.Bytes()[at:], uint32(addr))
+}
+
+// writeJump writes a jump with a placeholder address and returns the
+// position of the address, which is later set by patchJump.
+func (g *codeGen) writeJump(op opCode) (at int) {
+	g.writeOp(op)
+	at = g.code.Len()
+	g.writeAddr(0)
+	return
+}
+
+// patchJump sets the address of the jump at position at to the current
+// end of the code.
+func (g *codeGen) patchJump(at int) {
+	g.patchAddr(at, g.code.Len())
+}
+
+func (g *codeGen) newVar(ident string, vtyp valTyp) *item {
+	return &item{typ: itemVar, vtyp: vtyp, ident: ident, val: g.scope.stackSize - 1, fn: g.fn}
+}
+
+func (g *codeGen) newParam(ident string, pos int) *item {
+	g.scope.stackSize++
+	return &item{typ: itemParam, vtyp: typAny, ident: ident, val: pos, fn: g.fn}
+}
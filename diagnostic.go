@@ -0,0 +1,174 @@
+package popi
+
+import (
+	"fmt"
+	"strings"
+)
+
+// spanError is an error which knows the range of the source it refers to.
+type spanError interface {
+	error
+	Span() Span
+	Msg() string
+}
+
+// FormatError renders the error as a diagnostic with the excerpt of the
+// source it refers to, e.g.
+//
+//	error: Unknown variable: totl
+//	 --> rules.popi:2:5
+//	  |
+//	2 | x = totl + 1
+//	  |     ^^^^
+//	  = hint: did you mean `total`?
+//
+// RuntimeError is rendered with the address and the mnemonic of the failing
+// instruction, its expression is underlined if the columns are known.
+// Errors without a position are rendered with the message only, errors of
+// ErrorList one after another.
+func FormatError(name string, src string, err error) string {
+	var sb strings.Builder
+	switch err := err.(type) {
+	case ErrorList:
+		for _, err := range err {
+			sb.WriteString(FormatError(name, src, err))
+		}
+	case *RuntimeError:
+		// before spanError, the address is shown too
+		fmt.Fprintf(&sb, "error: %s\n", err.Msg())
+		span := err.Span()
+		line := span.Start.Line
+		if line == 0 {
+			fmt.Fprintf(&sb, " --> %s: address %d (%s)\n", name, err.Addr(), err.Op())
+			break
+		}
+		width := len(fmt.Sprint(line))
+		indent := strings.Repeat(" ", width)
+		pos := fmt.Sprint(line)
+		if span.Start.Col > 0 {
+			pos += fmt.Sprintf(":%d", span.Start.Col)
+		}
+		fmt.Fprintf(&sb, "%s--> %s:%s: address %d (%s)\n", indent, name, pos, err.Addr(), err.Op())
+		if text, ok := sourceLine(src, line); ok {
+			fmt.Fprintf(&sb, "%s |\n", indent)
+			fmt.Fprintf(&sb, "%d | %s\n", line, text)
+			if span.Start.Col > 0 {
+				fmt.Fprintf(&sb, "%s | %s\n", indent, underline(text, span))
+			}
+		}
+	case spanError:
+		span := err.Span()
+		fmt.Fprintf(&sb, "error: %s\n", err.Msg())
+		line := span.Start.Line
+		width := len(fmt.Sprint(line))
+		indent := strings.Repeat(" ", width)
+		fmt.Fprintf(&sb, "%s--> %s:%d:%d\n", indent, name, line, span.Start.Col)
+		if text, ok := sourceLine(src, line); ok {
+			fmt.Fprintf(&sb, "%s |\n", indent)
+			fmt.Fprintf(&sb, "%d | %s\n", line, text)
+			fmt.Fprintf(&sb, "%s | %s\n", indent, underline(text, span))
+		}
+		if herr, ok := err.(interface{ Hint() string }); ok && herr.Hint() != "" {
+			fmt.Fprintf(&sb, "%s = hint: %s\n", indent, herr.Hint())
+		}
+	default:
+		fmt.Fprintf(&sb, "error: %s\n", err)
+		fmt.Fprintf(&sb, " --> %s\n", name)
+	}
+	return sb.String()
+}
+
+// sourceLine returns the line of the source without the line break.
+func sourceLine(src string, line int) (text string, ok bool) {
+	lines := strings.Split(src, "\n")
+	if line < 1 || line > len(lines) {
+		return
+	}
+	return strings.TrimRight(lines[line-1], "\r"), true
+}
+
+// underline returns carets under the span within the line text. Spans
+// reaching to the next lines are underlined up to the end of the line,
+// an empty span gets a single caret. Tabs before the span are kept, so
+// the carets are aligned however wide the tabs are displayed.
+func underline(text string, span Span) string {
+	runes := []rune(text)
+	start := span.Start.Col - 1
+	if start > len(runes) {
+		start = len(runes)
+	}
+	end := len(runes)
+	if span.End.Line == span.Start.Line && span.End.Col-1 < end {
+		end = span.End.Col - 1
+	}
+	var sb strings.Builder
+	for _, r := range runes[:start] {
+		if r == '\t' {
+			sb.WriteRune('\t')
+		} else {
+			sb.WriteRune(' ')
+		}
+	}
+	n := end - start
+	if n < 1 {
+		n = 1
+	}
+	sb.WriteString(strings.Repeat("^", n))
+	return sb.String()
+}
+
+// suggest returns the candidate closest to the misspelled ident, or
+// an empty string if none is close enough.
+func suggest(ident string, candidates []string) (best string) {
+	max := len([]rune(ident)) / 3
+	if max < 1 {
+		max = 1
+	}
+	bestDist := max + 1
+	for _, c := range candidates {
+		if c == ident {
+			continue
+		}
+		if d := editDistance(ident, c); d < bestDist {
+			best, bestDist = c, d
+		}
+	}
+	return
+}
+
+// editDistance returns the number of inserted, deleted, substituted and
+// transposed adjacent chars needed to turn one string into the other.
+func editDistance(a, b string) int {
+	s, t := []rune(a), []rune(b)
+	d := make([][]int, len(s)+1)
+	for i := range d {
+		d[i] = make([]int, len(t)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+	for i := 1; i <= len(s); i++ {
+		for j := 1; j <= len(t); j++ {
+			cost := 1
+			if s[i-1] == t[j-1] {
+				cost = 0
+			}
+			d[i][j] = min3(d[i-1][j]+1, d[i][j-1]+1, d[i-1][j-1]+cost)
+			if i > 1 && j > 1 && s[i-1] == t[j-2] && s[i-2] == t[j-1] && d[i-2][j-2]+1 < d[i][j] {
+				d[i][j] = d[i-2][j-2] + 1
+			}
+		}
+	}
+	return d[len(s)][len(t)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
@@ -0,0 +1,91 @@
+package popi
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFormatParserError(t *testing.T) {
+	src := "let total = 10\nlet x = totl + 1"
+	_, err := newParser(strings.NewReader(src)).Parse()
+	expected := "error: Unknown variable: totl\n" +
+		" --> rules.popi:2:9\n" +
+		"  |\n" +
+		"2 | let x = totl + 1\n" +
+		"  |         ^^^^\n" +
+		"  = hint: did you mean `total`?\n"
+	checkEqualString(t, expected, FormatError("rules.popi", src, err))
+}
+
+func TestFormatLexerError(t *testing.T) {
+	src := "let x = 1\n\ty = \"abc\n"
+	_, err := newParser(strings.NewReader(src)).Parse()
+	expected := "error: Unterminated string\n" +
+		" --> a.popi:2:6\n" +
+		"  |\n" +
+		"2 | \ty = \"abc\n" +
+		"  | \t    ^^^^\n"
+	checkEqualString(t, expected, FormatError("a.popi", src, err))
+}
+
+func TestFormatErrorAtEOF(t *testing.T) {
+	src := strings.Repeat("\n", 9) + "f = fn(a) { a"
+	_, err := newParser(strings.NewReader(src)).Parse()
+	expected := "error: Unexpected token: EOF, } expected\n" +
+		"  --> a.popi:10:14\n" +
+		"   |\n" +
+		"10 | f = fn(a) { a\n" +
+		"   |              ^\n"
+	checkEqualString(t, expected, FormatError("a.popi", src, err))
+}
+
+func TestFormatRuntimeError(t *testing.T) {
+	src := "let x = 1\n\nlet y = 2 + x / 0"
+	err := newInterpreter(compile(t, src)).exec()
+	expected := "error: Division by zero\n" +
+		" --> a.popi:3:13: address 13 (divi)\n" +
+		"  |\n" +
+		"3 | let y = 2 + x / 0\n" +
+		"  |             ^^^^^\n"
+	checkEqualString(t, expected, FormatError("a.popi", src, err))
+
+	// assembled code has lines only
+	err = newInterpreter(assemble(t, "pushi 1\npushi 0\ndivi")).exec()
+	expected = "error: Division by zero\n" +
+		" --> a.popi:3: address 6 (divi)\n" +
+		"  |\n" +
+		"3 | divi\n"
+	checkEqualString(t, expected, FormatError("a.popi", "pushi 1\npushi 0\ndivi", err))
+
+	// without the debug line table only the address is known
+	prog := compile(t, "1 / 0")
+	prog.lines = nil
+	err = newInterpreter(prog).exec()
+	expected = "error: Division by zero\n" +
+		" --> a.popi: address 6 (divi)\n"
+	checkEqualString(t, expected, FormatError("a.popi", "1 / 0", err))
+}
+
+func TestSuggest(t *testing.T) {
+	names := []string{"total", "count", "x", "len"}
+	checkEqualString(t, "total", suggest("totl", names))
+	checkEqualString(t, "count", suggest("cuont", names))
+	checkEqualString(t, "x", suggest("y", names))
+	checkEqualString(t, "", suggest("price", names))
+}
+
+func TestFormatErrorList(t *testing.T) {
+	src := "x = *\ny = 1 +"
+	_, err := newParser(strings.NewReader(src)).Parse()
+	expected := "error: Unexpected token: *, value expected\n" +
+		" --> a.popi:1:5\n" +
+		"  |\n" +
+		"1 | x = *\n" +
+		"  |     ^\n" +
+		"error: Unexpected token: EOF, value expected\n" +
+		" --> a.popi:2:8\n" +
+		"  |\n" +
+		"2 | y = 1 +\n" +
+		"  |        ^\n"
+	checkEqualString(t, expected, FormatError("a.popi", src, err))
+}
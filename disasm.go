@@ -0,0 +1,144 @@
+package popi
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Disassemble writes the listing of the code of the program, one
+// instruction per line with its address, mnemonic and operands, e.g.
+//
+//	; line 1
+//	0000  jmp    12
+//	      ; fn at 5, 1 param
+//	0005  get    0
+//	0007  pushi  2           ; #0
+//	0010  mul
+//	0011  ret
+//	      ; end fn at 5
+//	0012  func   fn at 5     ; #1
+//
+// A closure is listed with the number of the cells it captures after the
+// function, e.g. closure fn at 5, 2.
+//
+// Constants are shown by value with their index in the constant pool,
+// globals by name. Lines of the source are shown where they change, if
+// the program has the debug line table. Malformed code is listed up to
+// the failing instruction, whose error is returned.
+func Disassemble(w io.Writer, prog *Program) (err error) {
+	var (
+		sb    strings.Builder
+		funcs = map[int]*Func{} // by the address of the body
+		ends  = map[int][]*Func{}
+		line  int
+		addr  int
+	)
+	for _, c := range prog.consts {
+		if c.kind == KindFunc {
+			f := c.ref.(*Func)
+			funcs[f.addr] = f
+		}
+	}
+	// the body of a function ends where the func instruction creating it
+	// starts, or the instructions pushing the cells of a closure
+	var addrs []int
+	code := newByteCode(prog.code)
+	for {
+		var in instr
+		if in, err = readInstr(code); err != nil {
+			break
+		}
+		addrs = append(addrs, in.addr)
+		if (in.op == opFunc || in.op == opClosure) && in.args[0] < len(prog.consts) {
+			end := in.addr
+			if k := len(addrs) - 1; in.op == opClosure && k >= in.args[1] {
+				end = addrs[k-in.args[1]]
+			}
+			if f, ok := prog.consts[in.args[0]].ref.(*Func); ok && f.addr < end {
+				ends[end] = append(ends[end], f)
+			}
+		}
+	}
+	if name := prog.Name(); name != "" {
+		fmt.Fprintf(&sb, "; %s\n", name)
+	}
+	code.SetAddr(0)
+	for err = nil; err == nil; {
+		addr = code.Addr()
+		fs := ends[addr]
+		sort.Slice(fs, func(i, j int) bool { return fs[i].addr > fs[j].addr })
+		for _, f := range fs {
+			fmt.Fprintf(&sb, "      ; end fn at %d\n", f.addr)
+		}
+		if f, ok := funcs[addr]; ok {
+			params := "params"
+			if f.arity == 1 {
+				params = "param"
+			}
+			fmt.Fprintf(&sb, "      ; fn at %d, %d %s\n", f.addr, f.arity, params)
+		}
+		if l := prog.Line(addr); l != line && l > 0 {
+			fmt.Fprintf(&sb, "; line %d\n", l)
+			line = l
+		}
+		var in instr
+		if in, err = readInstr(code); err != nil {
+			break
+		}
+		var args, comment []string
+		for k, arg := range in.args {
+			switch opArgs[in.op][k] {
+			case argConst:
+				if arg >= len(prog.consts) {
+					err = fmt.Errorf("Invalid constant: %d", arg)
+					continue
+				}
+				args = append(args, formatConst(prog.consts[arg]))
+				comment = append(comment, fmt.Sprintf("#%d", arg))
+			case argCount:
+				args = append(args, strconv.Itoa(arg))
+				if in.op == opGetGlobal && arg < len(prog.globals) {
+					comment = append(comment, prog.globals[arg])
+				}
+			default:
+				args = append(args, strconv.Itoa(arg))
+			}
+		}
+		if err != nil {
+			break
+		}
+		text := fmt.Sprintf("%04d  %-6s %s", in.addr, in.op, strings.Join(args, ", "))
+		if len(comment) > 0 {
+			text = fmt.Sprintf("%-24s ; %s", text, strings.Join(comment, ", "))
+		}
+		sb.WriteString(strings.TrimRight(text, " "))
+		sb.WriteByte('\n')
+	}
+	if err == io.EOF {
+		err = nil
+	} else {
+		err = fmt.Errorf("%w at address %d", err, addr)
+	}
+	if _, werr := io.WriteString(w, sb.String()); err == nil {
+		err = werr
+	}
+	return
+}
+
+// formatConst formats the constant as written in the source.
+func formatConst(c Value) string {
+	switch c.kind {
+	case KindString:
+		return strconv.Quote(c.String())
+	case KindFloat:
+		s := c.String()
+		if !strings.ContainsAny(s, ".eEnI") {
+			s += ".0"
+		}
+		return s
+	}
+	return c.String()
+}
@@ -0,0 +1,93 @@
+package popi
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDisassemble(t *testing.T) {
+	prog, err := Compile(`let twice = fn(x) { x * 2 }
+if twice(total) > 1.5 { "big" }`, &Options{Name: "a.popi", Globals: []string{"total"}})
+	if err != nil {
+		t.Fatalf("%s: %v", t.Name(), err)
+	}
+	var sb strings.Builder
+	if err = Disassemble(&sb, prog); err != nil {
+		t.Fatalf("%s: %v", t.Name(), err)
+	}
+	expected := `; a.popi
+; line 1
+0000  jmp    12
+      ; fn at 5, 1 param
+0005  get    0
+0007  pushi  2           ; #0
+0010  mul
+0011  ret
+      ; end fn at 5
+0012  func   fn at 5     ; #1
+; line 2
+0015  get    0
+0017  getg   0           ; total
+0019  call   1
+0021  pushf  1.5         ; #2
+0024  gt
+0025  jmpf   38
+0030  pushs  "big"       ; #3
+0033  jmp    39
+0038  nil
+`
+	checkEqualString(t, expected, sb.String())
+}
+
+func TestDisassembleClosure(t *testing.T) {
+	prog, err := Compile("let adder = fn(n) { fn(x) { x + n } }", nil)
+	if err != nil {
+		t.Fatalf("%s: %v", t.Name(), err)
+	}
+	var sb strings.Builder
+	if err = Disassemble(&sb, prog); err != nil {
+		t.Fatalf("%s: %v", t.Name(), err)
+	}
+	expected := `; line 1
+0000  jmp    28
+      ; fn at 5, 1 param
+0005  get    0
+0007  cell
+0008  set    0
+0010  jmp    21
+      ; fn at 15, 1 param
+0015  get    0
+0017  getu   0
+0019  add
+0020  ret
+      ; end fn at 15
+0021  get    0
+0023  closure fn at 15, 1 ; #0
+0027  ret
+      ; end fn at 5
+0028  func   fn at 5     ; #1
+0031  dup
+`
+	checkEqualString(t, expected, sb.String())
+}
+
+func TestDisassembleErrors(t *testing.T) {
+	tests := []struct {
+		code     []byte
+		expected string
+		msg      string
+	}{
+		{[]byte{opTrue, opJmp, 1, 0}, "0000  true\n", "Unexpected end of code at address 1"},
+		{[]byte{opPushI, 5, 0}, "", "Invalid constant: 5 at address 0"},
+		{[]byte{opNil, 200}, "0000  nil\n", "Unknown opcode: 200 at address 1"},
+	}
+	for _, test := range tests {
+		var sb strings.Builder
+		err := Disassemble(&sb, &Program{code: test.code})
+		if err == nil {
+			t.Fatalf("%s: expected error for %v", t.Name(), test.code)
+		}
+		checkEqualString(t, test.expected, sb.String())
+		checkEqualString(t, test.msg, err.Error())
+	}
+}
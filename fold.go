@@ -0,0 +1,145 @@
+package popi
+
+// fold replaces the constant subexpressions of the tree by their values,
+// e.g. 1 + 2 * 3 by 7, so they are not evaluated on every run. Operations
+// failing at run time, e.g. division by zero, are kept, so the program
+// fails as it would without folding. The node is changed in place, the
+// node to use instead of it is returned.
+func fold(n node) node {
+	switch n := n.(type) {
+	case *binaryExpr:
+		n.X = fold(n.X)
+		n.Y = fold(n.Y)
+		if lit := foldBinary(n); lit != nil {
+			return lit
+		}
+	case *unaryExpr:
+		n.X = fold(n.X)
+		if lit := foldUnary(n); lit != nil {
+			return lit
+		}
+	case *assign:
+		n.Val = fold(n.Val)
+	case *funcLit:
+		fold(n.Body)
+	case *callExpr:
+		n.Fn = fold(n.Fn)
+		for i, arg := range n.Args {
+			n.Args[i] = fold(arg)
+		}
+	case *selectorExpr:
+		n.X = fold(n.X)
+	case *indexExpr:
+		n.X = fold(n.X)
+		n.Index = fold(n.Index)
+	case *block:
+		for i, x := range n.List {
+			n.List[i] = fold(x)
+		}
+	case *ifExpr:
+		n.Cond = fold(n.Cond)
+		fold(n.Then)
+		if n.Else != nil {
+			n.Else = fold(n.Else)
+		}
+	case *whileExpr:
+		n.Cond = fold(n.Cond)
+		fold(n.Body)
+	case *forExpr:
+		n.From = fold(n.From)
+		n.To = fold(n.To)
+		fold(n.Body)
+	case *returnExpr:
+		if n.Val != nil {
+			n.Val = fold(n.Val)
+		}
+	}
+	return n
+}
+
+// foldBinary returns the literal of the value of the operation, or nil if
+// the operation is not constant or fails.
+func foldBinary(n *binaryExpr) node {
+	x, ok := literalValue(n.X)
+	if !ok {
+		return nil
+	}
+	y, ok := literalValue(n.Y)
+	if !ok {
+		return nil
+	}
+	var (
+		res Value
+		err error
+	)
+	if op, ok := compareOps[n.Op]; ok {
+		var c int
+		switch op {
+		case opEq:
+			res = BoolValue(equal(x, y))
+		case opNe:
+			res = BoolValue(!equal(x, y))
+		default:
+			if c, err = compare(x, y); err == nil {
+				res = BoolValue(op == opLt && c < 0 || op == opLe && c <= 0 ||
+					op == opGt && c > 0 || op == opGe && c >= 0)
+			}
+		}
+	} else {
+		op := arithOps[n.Op][2]
+		if f, ok := toFloat(y); ok && (op == opDiv || op == opMod) && f == 0 {
+			// division by zero fails with ints, and is kept with floats
+			// too, not to turn it into an infinity or NaN
+			return nil
+		}
+		res, err = arith(op, x, y)
+	}
+	if err != nil {
+		return nil
+	}
+	return literal(res, n.span)
+}
+
+// foldUnary returns the literal of the value of the operation, or nil if
+// the operand is not a literal or the operation fails.
+func foldUnary(n *unaryExpr) node {
+	x, ok := literalValue(n.X)
+	if !ok {
+		return nil
+	}
+	res, err := unary(unaryOps[n.Op], x)
+	if err != nil {
+		return nil
+	}
+	return literal(res, n.span)
+}
+
+// literalValue returns the value of the literal.
+func literalValue(n node) (val Value, ok bool) {
+	switch n := n.(type) {
+	case *intLit:
+		return IntValue(n.Val), true
+	case *floatLit:
+		return FloatValue(n.Val), true
+	case *stringLit:
+		return StringValue(n.Val), true
+	case *boolLit:
+		return BoolValue(n.Val), true
+	}
+	return
+}
+
+// literal returns the literal of the value.
+func literal(val Value, span Span) node {
+	switch val.kind {
+	case KindInt:
+		return &intLit{nodeSpan{span}, val.Int()}
+	case KindFloat:
+		return &floatLit{nodeSpan{span}, val.Float()}
+	case KindString:
+		return &stringLit{nodeSpan{span}, val.String()}
+	case KindBool:
+		return &boolLit{nodeSpan{span}, val.Bool()}
+	}
+	return nil
+}
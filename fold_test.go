@@ -0,0 +1,123 @@
+package popi
+
+import (
+	"testing"
+)
+
+// countInstrs returns the number of instructions of the code.
+func countInstrs(t *testing.T, prog *Program) (n int) {
+	code := newByteCode(prog.code)
+	for code.Addr() < len(prog.code) {
+		if _, err := readInstr(code); err != nil {
+			t.Fatalf("%s: %v", t.Name(), err)
+		}
+		n++
+	}
+	return
+}
+
+// foldTest is a source, its value and the number of instructions of its
+// code.
+type foldTest struct {
+	src    string
+	val    interface{}
+	instrs int
+}
+
+// checkFold compiles the sources of the tests without the peephole
+// optimizer, which would remove instructions too, and runs them.
+func checkFold(t *testing.T, tests []foldTest) {
+	for _, test := range tests {
+		prog := compile(t, test.src)
+		checkEqualInt(t, test.instrs, countInstrs(t, prog))
+		i := newInterpreter(prog)
+		if err := i.exec(); err != nil {
+			t.Fatalf("%s: %s: %v", t.Name(), test.src, err)
+		}
+		checkPop(t, test.src, i, test.val)
+	}
+}
+
+func TestFold(t *testing.T) {
+	checkFold(t, []foldTest{
+		{"1 + 2 * 3 - 4 / 2", 5, 1},
+		{"1 + 2 * 3 + 4", 11, 1},
+		{"7 / 2", 3, 1},
+		{"1 + 0.5", 1.5, 1},
+		{"1.5 * 2", 3.0, 1},
+		{`"a" + "b" + "c"`, "abc", 1},
+		{"1 < 2", true, 1},
+		{"2 * 3 == 6.0", true, 1},
+		{`"a" != "b"`, true, 1},
+		{`"abc" >= "abd"`, false, 1},
+		// let x = 3 is pushi into the slot of x, dup as the value of the
+		// declaration and drop of the value, the rest is only partly constant
+		{"let x = 3; 2 * 2 * x", 12, 6},
+		{"let x = 3; x + 2 * 3 - 1", 8, 8},
+		{"let f = fn(a) { 10 / 5 * a }; f(4)", 8, 11},
+		{"if 1 < 2 { 10 + 1 } else { 0 }", 11, 5},
+		{"-(1 + 2) * 2", -6, 1},
+		{"2 ** 3 ** 2 % 100", 12, 1},
+		{"-1.5 ** 2", -2.25, 1},
+		{"!(1 < 2)", false, 1},
+		{"+3", 3, 1},
+		{"let x = 3; x * -2", -6, 6},
+	})
+}
+
+func TestFoldIdentity(t *testing.T) {
+	checkFold(t, []foldTest{
+		// let x = 3 is pushi into the slot of x, dup as the value of the
+		// declaration and drop of the value, x is get
+		{"let x = 3; x * 1", 3, 4},
+		{"let x = 3; 1 * x", 3, 4},
+		{"let x = 3; x + 0", 3, 4},
+		{"let x = 3; 0 + x", 3, 4},
+		{"let x = 3; x - 0", 3, 4},
+		{"let x = 3; x / 1", 3, 4},
+		{"let x = 3; 2 / 2 * x", 3, 4},
+		{"let x = 1.5; x * 1.0", 1.5, 4},
+		{"let x = 1.5; x / 1.0", 1.5, 4},
+		{"let x = 1.5; x - 0.0", 1.5, 4},
+		// not identities
+		{"let x = 3; 0 - x", -3, 6},
+		{"let x = 3; 1 / x", 0, 6},
+		{"let x = 3; x * 1.0", 3.0, 6},
+		{"let x = 3.0; x + 0", 3.0, 6},
+		{"let x = 3.0; x + 0.0", 3.0, 6},
+	})
+}
+
+func TestFoldKeepsErrors(t *testing.T) {
+	tests := []struct {
+		src    string
+		msg    string
+		instrs int
+	}{
+		{"1 / 0", "Division by zero", 3},
+		{"2 * 3 / 0", "Division by zero", 3},
+		{"1 + 4 / 0", "Division by zero", 5},
+		{"1 % 0", "Division by zero", 3},
+		{"2 ** -1", "Negative exponent of int", 3},
+		{"-true", "Unexpected value: bool, number expected", 2},
+		{"!1", "Unexpected value: int, bool expected", 2},
+		{`+"a"`, "Unexpected value: string, number expected", 2},
+		{`"a" + 1`, "Unexpected value: int, string expected", 3},
+		{`1 + "a"`, "Unexpected value: string, number expected", 3},
+		{`1 < "a"`, "Unexpected value: string, number expected", 3},
+		// the identity of strings is not known
+		{`let x = "a"; x * 1`, "Unexpected value: string, number expected", 6},
+		{`let x = "a"; 0 + x`, "Unexpected value: string, number expected", 6},
+	}
+	for _, test := range tests {
+		prog := compile(t, test.src)
+		checkEqualInt(t, test.instrs, countInstrs(t, prog))
+		err := execError(t, prog)
+		checkEqualString(t, test.msg, err.Msg())
+	}
+	// float division by zero is not folded either
+	prog := compile(t, "1.0 / 0.0")
+	checkEqualInt(t, 3, countInstrs(t, prog))
+	prog = compile(t, "1.0 % 0.0")
+	checkEqualInt(t, 3, countInstrs(t, prog))
+}
@@ -1,130 +1,301 @@
-package main
+package popi
 
 import (
-	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"strings"
+	"unicode/utf8"
 )
 
-type StackFrame struct {
+type RuntimeError struct {
+	op   opCode
+	addr int
+	span Span // zero if the program has no debug info
+	msg  string
+	err  error
+}
+
+func (err *RuntimeError) Error() string {
+	return fmt.Sprintf("%s at address %d (%s)", err.msg, err.addr, err.op)
+}
+
+// Op returns the mnemonic of the failing instruction, e.g. call.
+func (err *RuntimeError) Op() string {
+	return err.op.String()
+}
+
+func (err *RuntimeError) Addr() int {
+	return err.addr
+}
+
+// Line returns the line of the source of the failing instruction, 0 if it
+// is not known.
+func (err *RuntimeError) Line() int {
+	return err.span.Start.Line
+}
+
+// Span returns the span of the source of the failing instruction, i.e. of
+// the expression it was compiled from. It is zero if it is not known, its
+// columns are 0 if only the line is known.
+func (err *RuntimeError) Span() Span {
+	return err.span
+}
+
+func (err *RuntimeError) Msg() string {
+	return err.msg
+}
+
+// Unwrap returns the error which caused the runtime error, e.g. the one
+// returned by a native function.
+func (err *RuntimeError) Unwrap() error {
+	return err.err
+}
+
+var (
+	errStackUnderflow = errors.New("Stack underflow")
+	errStackOverflow  = errors.New("Stack overflow")
+	errUnexpectedEnd  = errors.New("Unexpected end of code")
+)
+
+// Limits of the stacks, so a runaway recursion fails with a runtime error
+// instead of exhausting the memory of the host. Calls check both, as the
+// data stack of a single frame is bounded by the code of the function.
+const (
+	maxCallDepth = 1 << 16
+	maxDataStack = 1 << 20
+)
+
+// Nil is the value of expressions which have no other value, e.g. an if
+// without else when its condition does not hold.
+type Nil struct{}
+
+func (Nil) String() string {
+	return "nil"
+}
+
+// Func is a function defined in the program.
+type Func struct {
+	addr  int
+	arity int
+}
+
+func (f *Func) String() string {
+	return fmt.Sprintf("fn at %d", f.addr)
+}
+
+// Closure is a function with the variables of the enclosing functions it
+// uses, each of them kept in a cell shared with the enclosing function and
+// other closures.
+type Closure struct {
+	fn     *Func
+	upvals []*cell
+}
+
+func (c *Closure) String() string {
+	return c.fn.String()
+}
+
+// cell is a variable captured by a closure.
+type cell struct {
+	val Value
+}
+
+// NativeFunc is a Go function callable from programs.
+type NativeFunc func(args []Value) (Value, error)
+
+// Native is a Go function registered by the host.
+type Native struct {
+	name  string
+	arity int // -1 if any number of arguments is accepted
+	fn    NativeFunc
+}
+
+func (f *Native) String() string {
+	return fmt.Sprintf("native fn %s", f.name)
+}
+
+type stackFrame struct {
 	addr int
 	dp   int
 }
 
-type Interpreter struct {
-	dataStack []interface{}
-	callStack []*StackFrame
+type interpreter struct {
+	dataStack []Value
+	callStack []stackFrame
 	dp        int
 	cp        int
-	code      *ByteCode
+	code      *byteCode
+	consts    []Value
+	globals   []Value
+	lines     []lineInfo
 }
 
-func NewInterpreter(buf []byte) *Interpreter {
-	code := NewByteCode(buf)
-	dataStack := make([]interface{}, 1<<10)
-	callStack := make([]*StackFrame, 1<<10)
+func newInterpreter(prog *Program) *interpreter {
+	code := newByteCode(prog.code)
+	dataStack := make([]Value, 1<<8)
+	callStack := make([]stackFrame, 1<<6)
 	dp := -1
 	cp := 0
-	callStack[cp] = &StackFrame{code.Addr(), dp}
-	return &Interpreter{dataStack, callStack, dp, cp, code}
+	callStack[cp] = stackFrame{code.Addr(), dp}
+	return &interpreter{dataStack, callStack, dp, cp, code, prog.consts, nil, prog.lines}
 }
 
-func (i *Interpreter) Exec() (err error) {
-	var c byte
-	for c, err = i.code.ReadByte(); err == nil; c, err = i.code.ReadByte() {
-		op := OpCode(c)
-		switch op {
-		case OpPushI:
-			if err = i.pushI(); err != nil {
-				return
-			}
-		case OpPushF:
-			if err = i.pushF(); err != nil {
-				return
-			}
-		case OpSwap:
-			if err = i.swap(); err != nil {
-				return
-			}
-		case OpDup:
-			if err = i.dup(); err != nil {
-				return
-			}
-		case OpOver:
-			if err = i.over(); err != nil {
-				return
-			}
-		case OpRot:
-			if err = i.rot(); err != nil {
-				return
-			}
-		case OpDrop:
-			if err = i.drop(); err != nil {
-				return
-			}
-		case OpGet:
-			if err = i.get(); err != nil {
-				return
-			}
-		case OpSetI:
-			if err = i.setI(); err != nil {
-				return
-			}
-		case OpSetF:
-			if err = i.setF(); err != nil {
-				return
-			}
-		case OpAddI:
-			if err = i.addI(); err != nil {
-				return
-			}
-		case OpSubI:
-			if err = i.subI(); err != nil {
-				return
-			}
-		case OpMulI:
-			if err = i.mulI(); err != nil {
-				return
-			}
-		case OpDivI:
-			if err = i.divI(); err != nil {
-				return
-			}
-		case OpAddF:
-			if err = i.addF(); err != nil {
-				return
-			}
-		case OpSubF:
-			if err = i.subF(); err != nil {
-				return
-			}
-		case OpMulF:
-			if err = i.mulF(); err != nil {
-				return
-			}
-		case OpDivF:
-			if err = i.divF(); err != nil {
-				return
-			}
-		case OpCall:
-			if err = i.call(); err != nil {
-				return
-			}
-		case OpRet:
-			if err = i.ret(); err != nil {
-				return
+// exec runs the code until its end. A failing instruction stops the
+// execution with RuntimeError.
+func (i *interpreter) exec() (err error) {
+	var (
+		c    byte
+		op   opCode
+		addr int
+	)
+	defer func() {
+		// the instructions check their operands, this is only the last
+		// resort for a host embedding the interpreter
+		if r := recover(); r != nil {
+			err = &RuntimeError{op, addr, spanAt(i.lines, addr), fmt.Sprintf("Internal error: %v", r), nil}
+		}
+	}()
+	for {
+		addr = i.code.Addr()
+		if c, err = i.code.ReadByte(); err != nil {
+			if err == io.EOF {
+				err = nil
 			}
-		default:
-			panic(fmt.Errorf("Unexpected opcode: %s", op))
+			return
+		}
+		op = opCode(c)
+		if err = i.execOp(op); err != nil {
+			return &RuntimeError{op, addr, spanAt(i.lines, addr), err.Error(), err}
 		}
 	}
-	if err == io.EOF {
-		err = nil
+}
+
+func (i *interpreter) execOp(op opCode) (err error) {
+	switch op {
+	case opPushI:
+		err = i.pushConst(KindInt)
+	case opPushF:
+		err = i.pushConst(KindFloat)
+	case opPushS:
+		err = i.pushConst(KindString)
+	case opTrue:
+		i.push(BoolValue(true))
+	case opFalse:
+		i.push(BoolValue(false))
+	case opNil:
+		i.push(Value{})
+	case opFunc:
+		err = i.function()
+	case opSwap:
+		err = i.swap()
+	case opDup:
+		err = i.dup()
+	case opOver:
+		err = i.over()
+	case opRot:
+		err = i.rot()
+	case opDrop:
+		err = i.drop()
+	case opGet:
+		err = i.get()
+	case opSet:
+		err = i.set()
+	case opGetGlobal:
+		err = i.getGlobal()
+	case opSetI:
+		err = i.setI()
+	case opSetF:
+		err = i.setF()
+	case opAddI:
+		err = i.addI()
+	case opSubI:
+		err = i.subI()
+	case opMulI:
+		err = i.mulI()
+	case opDivI:
+		err = i.divI()
+	case opAddF:
+		err = i.addF()
+	case opSubF:
+		err = i.subF()
+	case opMulF:
+		err = i.mulF()
+	case opDivF:
+		err = i.divF()
+	case opModI:
+		err = i.modI()
+	case opPowI:
+		err = i.powI()
+	case opModF:
+		err = i.modF()
+	case opPowF:
+		err = i.powF()
+	case opAdd, opSub, opMul, opDiv, opMod, opPow:
+		err = i.arith(op)
+	case opNeg, opNot, opPos:
+		err = i.unary(op)
+	case opLen:
+		err = i.length()
+	case opField:
+		err = i.field()
+	case opIndex:
+		err = i.index()
+	case opEq:
+		err = i.eq()
+	case opNe:
+		err = i.ne()
+	case opLt:
+		err = i.lt()
+	case opLe:
+		err = i.le()
+	case opGt:
+		err = i.gt()
+	case opGe:
+		err = i.ge()
+	case opJmp:
+		err = i.jmp()
+	case opJmpF:
+		err = i.jmpF()
+	case opCall:
+		err = i.call()
+	case opTailCall:
+		err = i.tailCall()
+	case opRet:
+		err = i.ret()
+	case opCell:
+		err = i.newCell()
+	case opGetCell:
+		err = i.getCell()
+	case opSetCell:
+		err = i.setCell()
+	case opGetUpval:
+		err = i.getUpval()
+	case opSetUpval:
+		err = i.setUpval()
+	case opRefUpval:
+		err = i.refUpval()
+	case opClosure:
+		err = i.closure()
+	default:
+		err = fmt.Errorf("Unknown opcode: %s", op)
+	}
+	return
+}
+
+// popGo pops the value as int, float64, bool, string, Nil, a function or
+// Object, or returns nil if the stack is empty.
+func (i *interpreter) popGo() (val interface{}) {
+	if i.dp < 0 {
+		return nil
 	}
+	val = i.dataStack[i.dp].box()
+	i.dp--
 	return
 }
 
-func (i *Interpreter) Push(val interface{}) {
+func (i *interpreter) push(val Value) {
 	i.dp++
 	if i.dp >= len(i.dataStack) {
 		i.growDataStack()
@@ -132,213 +303,1022 @@ func (i *Interpreter) Push(val interface{}) {
 	i.dataStack[i.dp] = val
 }
 
-func (i *Interpreter) Pop() (val interface{}) {
-	if i.dp < 0 {
-		return nil
+// pop pops a value of the current stack frame.
+func (i *interpreter) pop() (val Value, err error) {
+	if i.dp <= i.stackFrame().dp {
+		err = errStackUnderflow
+		return
 	}
 	val = i.dataStack[i.dp]
 	i.dp--
 	return
 }
 
-func (i *Interpreter) growDataStack() {
+func (i *interpreter) popInt() (n int, err error) {
+	var val Value
+	if val, err = i.pop(); err != nil {
+		return
+	}
+	if val.kind != KindInt {
+		return 0, typeError("int", val)
+	}
+	return int(val.num), nil
+}
+
+func (i *interpreter) popFloat() (n float64, err error) {
+	var val Value
+	if val, err = i.pop(); err != nil {
+		return
+	}
+	if val.kind != KindFloat {
+		return 0, typeError("float", val)
+	}
+	return math.Float64frombits(val.num), nil
+}
+
+func (i *interpreter) popBool() (b bool, err error) {
+	var val Value
+	if val, err = i.pop(); err != nil {
+		return
+	}
+	if val.kind != KindBool {
+		return false, typeError("bool", val)
+	}
+	return val.num != 0, nil
+}
+
+func (i *interpreter) popInts() (x int, y int, err error) {
+	if y, err = i.popInt(); err != nil {
+		return
+	}
+	x, err = i.popInt()
+	return
+}
+
+func (i *interpreter) popFloats() (x float64, y float64, err error) {
+	if y, err = i.popFloat(); err != nil {
+		return
+	}
+	x, err = i.popFloat()
+	return
+}
+
+func (i *interpreter) popTwo() (x Value, y Value, err error) {
+	if y, err = i.pop(); err != nil {
+		return
+	}
+	x, err = i.pop()
+	return
+}
+
+// need checks the current stack frame holds at least n values.
+func (i *interpreter) need(n int) error {
+	if i.dp-i.stackFrame().dp < n {
+		return errStackUnderflow
+	}
+	return nil
+}
+
+func (i *interpreter) growDataStack() {
 	o := len(i.dataStack)
 	n := o * 2
 	tmp := i.dataStack
-	i.dataStack = make([]interface{}, n)
+	i.dataStack = make([]Value, n)
 	copy(i.dataStack, tmp)
 }
 
-func (i *Interpreter) growCallStack() {
+func (i *interpreter) growCallStack() {
 	o := len(i.callStack)
 	n := o * 2
 	tmp := i.callStack
-	i.callStack = make([]*StackFrame, n)
+	i.callStack = make([]stackFrame, n)
 	copy(i.callStack, tmp)
 }
 
-func (i *Interpreter) offsetToAddr(offset int) (addr int) {
+// offsetToAddr converts the offset of a variable to its address on the
+// data stack. The address must lie within the current stack frame.
+func (i *interpreter) offsetToAddr(offset int) (addr int, err error) {
 	if offset >= 0 {
 		addr = i.callStack[i.cp].dp + offset + 1
 	} else {
 		addr = i.dp + offset
 	}
+	if addr <= i.stackFrame().dp || addr > i.dp {
+		err = fmt.Errorf("Invalid variable offset: %d", offset)
+	}
 	return
 }
 
-func (i *Interpreter) stackFrame() (frame *StackFrame) {
-	return i.callStack[i.cp]
+func (i *interpreter) stackFrame() (frame *stackFrame) {
+	return &i.callStack[i.cp]
 }
 
-func (i *Interpreter) pushI() (err error) {
-	var n int
-	if n, err = i.readInt(); err != nil {
-		return err
+// pushConst pushes a constant of the kind from the constant pool.
+func (i *interpreter) pushConst(kind Kind) (err error) {
+	var val Value
+	if val, err = i.readConst(kind); err != nil {
+		return
 	}
-	i.Push(n)
+	i.push(val)
 	return
 }
 
-func (i *Interpreter) pushF() (err error) {
-	var n float64
-	if n, err = i.readFloat(); err != nil {
-		return err
+// length pushes the number of characters of a string or the number of
+// elements of an object.
+func (i *interpreter) length() (err error) {
+	var val Value
+	if val, err = i.pop(); err != nil {
+		return
+	}
+	switch val.kind {
+	case KindString:
+		i.push(IntValue(utf8.RuneCountInString(val.ref.(string))))
+		return
+	case KindObject:
+		if n, ok := val.ref.(Object).length(); ok {
+			i.push(IntValue(n))
+			return
+		}
+	}
+	return typeError("string", val)
+}
+
+// field pushes the field or the method of an object.
+func (i *interpreter) field() (err error) {
+	var name, val, res Value
+	if name, err = i.readConst(KindString); err != nil {
+		return
+	}
+	if val, err = i.pop(); err != nil {
+		return
+	}
+	if val.kind != KindObject {
+		return typeError("object", val)
+	}
+	if res, err = val.ref.(Object).field(name.ref.(string)); err != nil {
+		return
+	}
+	i.push(res)
+	return
+}
+
+// index pushes the element of an object.
+func (i *interpreter) index() (err error) {
+	var x, y, res Value
+	if x, y, err = i.popTwo(); err != nil {
+		return
+	}
+	if x.kind != KindObject {
+		return typeError("object", x)
+	}
+	if res, err = x.ref.(Object).index(y); err != nil {
+		return
 	}
-	i.Push(n)
+	i.push(res)
 	return
 }
 
-func (i *Interpreter) drop() (err error) {
-	i.Pop()
+func (i *interpreter) drop() (err error) {
+	_, err = i.pop()
 	return
 }
 
-func (i *Interpreter) get() (err error) {
-	var offset int
-	if offset, err = i.readInt(); err != nil {
+func (i *interpreter) get() (err error) {
+	var offset, addr int
+	if offset, err = i.readOffset(); err != nil {
 		return
 	}
-	addr := i.offsetToAddr(offset)
-	i.Push(i.dataStack[addr])
+	if addr, err = i.offsetToAddr(offset); err != nil {
+		return
+	}
+	i.push(i.dataStack[addr])
 	return
 }
 
-func (i *Interpreter) setI() (err error) {
+func (i *interpreter) getGlobal() (err error) {
+	var idx int
+	if idx, err = i.readCount(); err != nil {
+		return
+	}
+	if idx >= len(i.globals) {
+		return fmt.Errorf("Invalid global: %d", idx)
+	}
+	i.push(i.globals[idx])
+	return
+}
+
+func (i *interpreter) set() (err error) {
 	var (
-		offset int
-		n      int
+		offset, addr int
+		val          Value
+	)
+	if offset, err = i.readOffset(); err != nil {
+		return
+	}
+	if val, err = i.pop(); err != nil {
+		return
+	}
+	if addr, err = i.offsetToAddr(offset); err != nil {
+		return
+	}
+	i.dataStack[addr] = val
+	return
+}
+
+func (i *interpreter) setI() (err error) {
+	var (
+		offset, addr int
+		n            Value
 	)
-	if offset, err = i.readInt(); err != nil {
+	if offset, err = i.readOffset(); err != nil {
 		return
 	}
-	if n, err = i.readInt(); err != nil {
+	if n, err = i.readConst(KindInt); err != nil {
+		return
+	}
+	if addr, err = i.offsetToAddr(offset); err != nil {
 		return
 	}
-	addr := i.offsetToAddr(offset)
 	i.dataStack[addr] = n
 	return
 }
 
-func (i *Interpreter) setF() (err error) {
+func (i *interpreter) setF() (err error) {
 	var (
-		offset int
-		n      float64
+		offset, addr int
+		n            Value
 	)
-	if offset, err = i.readInt(); err != nil {
+	if offset, err = i.readOffset(); err != nil {
+		return
+	}
+	if n, err = i.readConst(KindFloat); err != nil {
 		return
 	}
-	if n, err = i.readFloat(); err != nil {
+	if addr, err = i.offsetToAddr(offset); err != nil {
 		return
 	}
-	addr := i.offsetToAddr(offset)
 	i.dataStack[addr] = n
 	return
 }
 
-func (i *Interpreter) swap() (err error) {
+func (i *interpreter) swap() (err error) {
+	if err = i.need(2); err != nil {
+		return
+	}
 	i.dataStack[i.dp], i.dataStack[i.dp-1] = i.dataStack[i.dp-1], i.dataStack[i.dp]
 	return
 }
 
-func (i *Interpreter) dup() (err error) {
-	i.Push(i.dataStack[i.dp])
+func (i *interpreter) dup() (err error) {
+	if err = i.need(1); err != nil {
+		return
+	}
+	i.push(i.dataStack[i.dp])
 	return
 }
 
-func (i *Interpreter) over() (err error) {
-	i.Push(i.dataStack[i.dp-1])
+func (i *interpreter) over() (err error) {
+	if err = i.need(2); err != nil {
+		return
+	}
+	i.push(i.dataStack[i.dp-1])
 	return
 }
 
-func (i *Interpreter) rot() (err error) {
+func (i *interpreter) rot() (err error) {
+	if err = i.need(3); err != nil {
+		return
+	}
 	i.dataStack[i.dp], i.dataStack[i.dp-1], i.dataStack[i.dp-2] =
 		i.dataStack[i.dp-1], i.dataStack[i.dp-2], i.dataStack[i.dp]
 	return
 }
 
-func (i *Interpreter) addI() (err error) {
-	y := i.Pop().(int)
-	x := i.Pop().(int)
-	i.Push(x + y)
+func (i *interpreter) addI() (err error) {
+	var x, y int
+	if x, y, err = i.popInts(); err != nil {
+		return
+	}
+	i.push(IntValue(x + y))
+	return
+}
+
+func (i *interpreter) subI() (err error) {
+	var x, y int
+	if x, y, err = i.popInts(); err != nil {
+		return
+	}
+	i.push(IntValue(x - y))
 	return
 }
 
-func (i *Interpreter) subI() (err error) {
-	y := i.Pop().(int)
-	x := i.Pop().(int)
-	i.Push(x - y)
+func (i *interpreter) mulI() (err error) {
+	var x, y int
+	if x, y, err = i.popInts(); err != nil {
+		return
+	}
+	i.push(IntValue(x * y))
 	return
 }
 
-func (i *Interpreter) mulI() (err error) {
-	y := i.Pop().(int)
-	x := i.Pop().(int)
-	i.Push(x * y)
+func (i *interpreter) divI() (err error) {
+	var x, y int
+	if x, y, err = i.popInts(); err != nil {
+		return
+	}
+	if y == 0 {
+		return errDivByZero
+	}
+	i.push(IntValue(x / y))
 	return
 }
 
-func (i *Interpreter) divI() (err error) {
-	y := i.Pop().(int)
-	x := i.Pop().(int)
-	i.Push(x / y)
+func (i *interpreter) modI() (err error) {
+	var x, y int
+	if x, y, err = i.popInts(); err != nil {
+		return
+	}
+	if y == 0 {
+		return errDivByZero
+	}
+	i.push(IntValue(x % y))
 	return
 }
 
-func (i *Interpreter) addF() (err error) {
-	y := i.Pop().(float32)
-	x := i.Pop().(float32)
-	i.Push(x + y)
+func (i *interpreter) powI() (err error) {
+	var x, y int
+	if x, y, err = i.popInts(); err != nil {
+		return
+	}
+	if y < 0 {
+		return errNegExp
+	}
+	i.push(IntValue(powInt(x, y)))
 	return
 }
 
-func (i *Interpreter) subF() (err error) {
-	y := i.Pop().(float32)
-	x := i.Pop().(float32)
-	i.Push(x - y)
+func (i *interpreter) addF() (err error) {
+	var x, y float64
+	if x, y, err = i.popFloats(); err != nil {
+		return
+	}
+	i.push(FloatValue(x + y))
 	return
 }
 
-func (i *Interpreter) mulF() (err error) {
-	y := i.Pop().(float32)
-	x := i.Pop().(float32)
-	i.Push(x * y)
+func (i *interpreter) subF() (err error) {
+	var x, y float64
+	if x, y, err = i.popFloats(); err != nil {
+		return
+	}
+	i.push(FloatValue(x - y))
 	return
 }
 
-func (i *Interpreter) divF() (err error) {
-	y := i.Pop().(float32)
-	x := i.Pop().(float32)
-	i.Push(x / y)
+func (i *interpreter) mulF() (err error) {
+	var x, y float64
+	if x, y, err = i.popFloats(); err != nil {
+		return
+	}
+	i.push(FloatValue(x * y))
 	return
 }
 
-func (i *Interpreter) call() (err error) {
-	addr := i.Pop().(int)
-	i.cp++
-	if i.cp >= len(i.callStack) {
-		i.growCallStack()
+func (i *interpreter) divF() (err error) {
+	var x, y float64
+	if x, y, err = i.popFloats(); err != nil {
+		return
 	}
-	i.callStack[i.cp] = &StackFrame{i.code.Addr(), i.dp}
-	i.code.SetAddr(addr)
+	i.push(FloatValue(x / y))
 	return
 }
 
-func (i *Interpreter) ret() (err error) {
+func (i *interpreter) modF() (err error) {
+	var x, y float64
+	if x, y, err = i.popFloats(); err != nil {
+		return
+	}
+	i.push(FloatValue(math.Mod(x, y)))
+	return
+}
+
+func (i *interpreter) powF() (err error) {
+	var x, y float64
+	if x, y, err = i.popFloats(); err != nil {
+		return
+	}
+	i.push(FloatValue(math.Pow(x, y)))
+	return
+}
+
+// function pushes a function of the constant pool.
+func (i *interpreter) function() (err error) {
+	var fn Value
+	if fn, err = i.readConst(KindFunc); err != nil {
+		return
+	}
+	if err = i.checkAddr(fn.ref.(*Func).addr); err != nil {
+		return
+	}
+	i.push(fn)
+	return
+}
+
+// closure pushes a closure of the function of the constant pool, the
+// cells it captures are popped.
+func (i *interpreter) closure() (err error) {
+	var (
+		fn Value
+		n  int
+	)
+	if fn, err = i.readConst(KindFunc); err != nil {
+		return
+	}
+	if n, err = i.readCount(); err != nil {
+		return
+	}
+	if err = i.checkAddr(fn.ref.(*Func).addr); err != nil {
+		return
+	}
+	if err = i.need(n); err != nil {
+		return
+	}
+	c := &Closure{fn.ref.(*Func), make([]*cell, n)}
+	for k := range c.upvals {
+		val := i.dataStack[i.dp-n+1+k]
+		if val.kind != kindCell {
+			return errors.New("Invalid cell")
+		}
+		c.upvals[k] = val.ref.(*cell)
+	}
+	i.dp -= n
+	i.push(closureValue(c))
+	return
+}
+
+// newCell replaces the value on the top of the stack by a cell holding it.
+func (i *interpreter) newCell() (err error) {
+	var val Value
+	if val, err = i.pop(); err != nil {
+		return
+	}
+	i.push(Value{kind: kindCell, ref: &cell{val}})
+	return
+}
+
+// cellAt returns the cell of the variable at the offset.
+func (i *interpreter) cellAt(offset int) (c *cell, err error) {
+	var addr int
+	if addr, err = i.offsetToAddr(offset); err != nil {
+		return
+	}
+	val := i.dataStack[addr]
+	if val.kind != kindCell {
+		return nil, errors.New("Invalid cell")
+	}
+	return val.ref.(*cell), nil
+}
+
+func (i *interpreter) getCell() (err error) {
+	var (
+		offset int
+		c      *cell
+	)
+	if offset, err = i.readOffset(); err != nil {
+		return
+	}
+	if c, err = i.cellAt(offset); err != nil {
+		return
+	}
+	i.push(c.val)
+	return
+}
+
+func (i *interpreter) setCell() (err error) {
+	var (
+		offset int
+		val    Value
+		c      *cell
+	)
+	if offset, err = i.readOffset(); err != nil {
+		return
+	}
+	if val, err = i.pop(); err != nil {
+		return
+	}
+	if c, err = i.cellAt(offset); err != nil {
+		return
+	}
+	c.val = val
+	return
+}
+
+// upval returns the cell captured by the running closure, which is kept
+// below its arguments.
+func (i *interpreter) upval() (c *cell, err error) {
+	var idx int
+	if idx, err = i.readCount(); err != nil {
+		return
+	}
+	if dp := i.stackFrame().dp; i.cp > 0 && i.dataStack[dp].kind == KindClosure {
+		if upvals := i.dataStack[dp].ref.(*Closure).upvals; idx < len(upvals) {
+			return upvals[idx], nil
+		}
+	}
+	return nil, fmt.Errorf("Invalid upvalue: %d", idx)
+}
+
+func (i *interpreter) getUpval() (err error) {
+	var c *cell
+	if c, err = i.upval(); err != nil {
+		return
+	}
+	i.push(c.val)
+	return
+}
+
+func (i *interpreter) setUpval() (err error) {
+	var (
+		c   *cell
+		val Value
+	)
+	if c, err = i.upval(); err != nil {
+		return
+	}
+	if val, err = i.pop(); err != nil {
+		return
+	}
+	c.val = val
+	return
+}
+
+// refUpval pushes the cell captured by the running closure, so it is
+// captured by a closure created in it too.
+func (i *interpreter) refUpval() (err error) {
+	var c *cell
+	if c, err = i.upval(); err != nil {
+		return
+	}
+	i.push(Value{kind: kindCell, ref: c})
+	return
+}
+
+func (i *interpreter) call() (err error) {
+	var argc int
+	if argc, err = i.readCount(); err != nil {
+		return
+	}
+	if err = i.need(argc + 1); err != nil {
+		return
+	}
+	dp := i.dp - argc
+	switch fn := i.dataStack[dp]; fn.kind {
+	case KindFunc, KindClosure:
+		var f *Func
+		if f, err = i.callee(fn, argc); err != nil {
+			return
+		}
+		if i.cp+1 >= maxCallDepth || i.dp >= maxDataStack {
+			return errStackOverflow
+		}
+		i.cp++
+		if i.cp >= len(i.callStack) {
+			i.growCallStack()
+		}
+		i.callStack[i.cp] = stackFrame{i.code.Addr(), dp}
+		i.code.SetAddr(f.addr)
+	case KindNative:
+		return i.callNative(fn.ref.(*Native), dp)
+	default:
+		return typeError("function", fn)
+	}
+	return
+}
+
+// tailCall calls the function in place of the running one, i.e. the
+// function and the arguments replace the frame and the result is returned
+// to the caller of the running function.
+func (i *interpreter) tailCall() (err error) {
+	var argc int
+	if argc, err = i.readCount(); err != nil {
+		return
+	}
+	if i.cp == 0 {
+		return errors.New("Tail call outside of function")
+	}
+	if err = i.need(argc + 1); err != nil {
+		return
+	}
+	dp := i.dp - argc
+	switch fn := i.dataStack[dp]; fn.kind {
+	case KindFunc, KindClosure:
+		var f *Func
+		if f, err = i.callee(fn, argc); err != nil {
+			return
+		}
+		frame := i.stackFrame()
+		copy(i.dataStack[frame.dp:], i.dataStack[dp:i.dp+1])
+		i.dp = frame.dp + argc
+		i.code.SetAddr(f.addr)
+	case KindNative:
+		if err = i.callNative(fn.ref.(*Native), dp); err != nil {
+			return
+		}
+		return i.ret()
+	default:
+		return typeError("function", fn)
+	}
+	return
+}
+
+// callee returns the function of the function or closure value called with
+// argc arguments.
+func (i *interpreter) callee(fn Value, argc int) (f *Func, err error) {
+	f, ok := fn.ref.(*Func)
+	if !ok {
+		f = fn.ref.(*Closure).fn
+	}
+	if argc != f.arity {
+		return nil, argCountError(argc, f.arity)
+	}
+	return
+}
+
+// callNative calls the Go function with the arguments above dp and
+// replaces the function and the arguments by the result.
+func (i *interpreter) callNative(fn *Native, dp int) (err error) {
+	argc := i.dp - dp
+	if fn.arity >= 0 && argc != fn.arity {
+		return argCountError(argc, fn.arity)
+	}
+	args := make([]Value, argc)
+	copy(args, i.dataStack[dp+1:i.dp+1])
+	var res Value
+	if res, err = fn.fn(args); err != nil {
+		return fmt.Errorf("%s: %w", fn.name, err)
+	}
+	i.dp = dp - 1
+	i.push(res)
+	return
+}
+
+func argCountError(argc int, arity int) error {
+	return fmt.Errorf("Wrong number of arguments: %d, %d expected", argc, arity)
+}
+
+func (i *interpreter) ret() (err error) {
+	if i.cp == 0 {
+		return errors.New("Return outside of function")
+	}
+	var val Value
+	if val, err = i.pop(); err != nil {
+		return
+	}
 	frame := i.callStack[i.cp]
-	i.dp = frame.dp
-	i.code.SetAddr(frame.addr + 1)
+	i.dp = frame.dp - 1
+	i.push(val)
+	i.code.SetAddr(frame.addr)
 	i.cp--
 	return
 }
 
-func (i *Interpreter) readInt() (n int, err error) {
-	var x int64
-	err = binary.Read(i.code, binary.LittleEndian, &x)
-	n = int(x)
+func (i *interpreter) jmp() (err error) {
+	var addr int
+	if addr, err = i.readAddr(); err != nil {
+		return
+	}
+	if err = i.checkAddr(addr); err != nil {
+		return
+	}
+	i.code.SetAddr(addr)
+	return
+}
+
+func (i *interpreter) jmpF() (err error) {
+	var (
+		addr int
+		cond bool
+	)
+	if addr, err = i.readAddr(); err != nil {
+		return
+	}
+	if err = i.checkAddr(addr); err != nil {
+		return
+	}
+	if cond, err = i.popBool(); err != nil {
+		return
+	}
+	if !cond {
+		i.code.SetAddr(addr)
+	}
+	return
+}
+
+// checkAddr checks the jump or call target lies within the code. The end
+// of the code is a valid target, jumping there ends the execution.
+func (i *interpreter) checkAddr(addr int) error {
+	if addr < 0 || addr > len(i.code.buf) {
+		return fmt.Errorf("Invalid address: %d", addr)
+	}
+	return nil
+}
+
+func (i *interpreter) eq() (err error) {
+	var x, y Value
+	if x, y, err = i.popTwo(); err != nil {
+		return
+	}
+	i.push(BoolValue(equal(x, y)))
+	return
+}
+
+func (i *interpreter) ne() (err error) {
+	var x, y Value
+	if x, y, err = i.popTwo(); err != nil {
+		return
+	}
+	i.push(BoolValue(!equal(x, y)))
+	return
+}
+
+func (i *interpreter) lt() (err error) {
+	return i.compare(func(c int) bool { return c < 0 })
+}
+
+func (i *interpreter) le() (err error) {
+	return i.compare(func(c int) bool { return c <= 0 })
+}
+
+func (i *interpreter) gt() (err error) {
+	return i.compare(func(c int) bool { return c > 0 })
+}
+
+func (i *interpreter) ge() (err error) {
+	return i.compare(func(c int) bool { return c >= 0 })
+}
+
+func (i *interpreter) compare(test func(c int) bool) (err error) {
+	var (
+		x, y Value
+		c    int
+	)
+	if x, y, err = i.popTwo(); err != nil {
+		return
+	}
+	if c, err = compare(x, y); err != nil {
+		return
+	}
+	i.push(BoolValue(test(c)))
+	return
+}
+
+// arith performs a generic arithmetic operation.
+func (i *interpreter) arith(op opCode) (err error) {
+	var x, y, res Value
+	if x, y, err = i.popTwo(); err != nil {
+		return
+	}
+	if res, err = arith(op, x, y); err != nil {
+		return
+	}
+	i.push(res)
+	return
+}
+
+// unary performs a negation of a number or a bool, or the unary plus.
+func (i *interpreter) unary(op opCode) (err error) {
+	var x, res Value
+	if x, err = i.pop(); err != nil {
+		return
+	}
+	if res, err = unary(op, x); err != nil {
+		return
+	}
+	i.push(res)
+	return
+}
+
+// unary returns the result of the unary operation, i.e. the negated number
+// of neg, the negated bool of not, or the number itself of pos.
+func unary(op opCode, x Value) (res Value, err error) {
+	if op == opNot {
+		if x.kind != KindBool {
+			return res, typeError("bool", x)
+		}
+		return BoolValue(x.num == 0), nil
+	}
+	switch {
+	case op == opPos && (x.kind == KindInt || x.kind == KindFloat):
+		return x, nil
+	case x.kind == KindInt:
+		return IntValue(-int(x.num)), nil
+	case x.kind == KindFloat:
+		return FloatValue(-x.Float()), nil
+	}
+	return res, typeError("number", x)
+}
+
+// arith returns the result of the generic arithmetic operation. Ints stay
+// ints, if one of the operands is float, the other one is converted to
+// float too. Strings can only be added.
+func arith(op opCode, x, y Value) (res Value, err error) {
+	if x.kind == KindString && op == opAdd {
+		if y.kind != KindString {
+			return res, typeError("string", y)
+		}
+		return StringValue(x.ref.(string) + y.ref.(string)), nil
+	}
+	if x.kind == KindInt && y.kind == KindInt {
+		a, b := int(x.num), int(y.num)
+		var n int
+		switch op {
+		case opAdd:
+			n = a + b
+		case opSub:
+			n = a - b
+		case opMul:
+			n = a * b
+		case opDiv:
+			if b == 0 {
+				return res, errDivByZero
+			}
+			n = a / b
+		case opMod:
+			if b == 0 {
+				return res, errDivByZero
+			}
+			n = a % b
+		case opPow:
+			if b < 0 {
+				return res, errNegExp
+			}
+			n = powInt(a, b)
+		}
+		return IntValue(n), nil
+	}
+	a, ok := toFloat(x)
+	if !ok {
+		return res, typeError("number", x)
+	}
+	b, ok := toFloat(y)
+	if !ok {
+		return res, typeError("number", y)
+	}
+	var n float64
+	switch op {
+	case opAdd:
+		n = a + b
+	case opSub:
+		n = a - b
+	case opMul:
+		n = a * b
+	case opDiv:
+		n = a / b
+	case opMod:
+		n = math.Mod(a, b)
+	case opPow:
+		n = math.Pow(a, b)
+	}
+	return FloatValue(n), nil
+}
+
+// powInt returns x to the power of the non negative n.
+func powInt(x int, n int) int {
+	res := 1
+	for ; n > 0; n >>= 1 {
+		if n&1 == 1 {
+			res *= x
+		}
+		x *= x
+	}
+	return res
+}
+
+var (
+	errDivByZero = errors.New("Division by zero")
+	errNegExp    = errors.New("Negative exponent of int")
+)
+
+func toFloat(x Value) (n float64, ok bool) {
+	switch x.kind {
+	case KindInt:
+		return float64(int(x.num)), true
+	case KindFloat:
+		return math.Float64frombits(x.num), true
+	}
+	return
+}
+
+// equal reports whether the values are equal, numbers are compared by
+// value regardless of being int or float.
+func equal(x, y Value) bool {
+	if x.kind == y.kind {
+		switch x.kind {
+		case KindFloat:
+			return x.Float() == y.Float()
+		case KindString:
+			return x.ref.(string) == y.ref.(string)
+		case KindFunc, KindNative, KindObject, KindClosure:
+			return x.ref == y.ref
+		}
+		return x.num == y.num
+	}
+	if a, ok := toFloat(x); ok {
+		if b, ok := toFloat(y); ok {
+			return a == b
+		}
+	}
+	return false
+}
+
+// compare returns -1, 0 or 1 if x is less than, equal to or greater than y.
+// Strings are compared lexicographically.
+func compare(x, y Value) (c int, err error) {
+	if x.kind == KindString {
+		if y.kind != KindString {
+			return 0, typeError("string", y)
+		}
+		return strings.Compare(x.ref.(string), y.ref.(string)), nil
+	}
+	if x.kind == KindInt && y.kind == KindInt {
+		a, b := int(x.num), int(y.num)
+		switch {
+		case a < b:
+			c = -1
+		case a > b:
+			c = 1
+		}
+		return
+	}
+	a, ok := toFloat(x)
+	if !ok {
+		return 0, typeError("number", x)
+	}
+	b, ok := toFloat(y)
+	if !ok {
+		return 0, typeError("number", y)
+	}
+	switch {
+	case a < b:
+		c = -1
+	case a > b:
+		c = 1
+	}
 	return
 }
 
-func (i *Interpreter) readFloat() (n float64, err error) {
-	err = binary.Read(i.code, binary.LittleEndian, n)
+func typeError(expected string, val Value) error {
+	return fmt.Errorf("Unexpected value: %s, %s expected", typeName(val), expected)
+}
+
+// typeName returns the kind of the value, or the Go type of an object.
+func typeName(val Value) string {
+	if val.kind == KindObject {
+		return val.ref.(Object).val.Type().String()
+	}
+	return val.kind.String()
+}
+
+// readConst reads the index of a constant of the kind. The end of code in
+// the middle of an operand is an error unlike the end of code before an
+// opcode.
+func (i *interpreter) readConst(kind Kind) (val Value, err error) {
+	idx, ok := i.code.ReadU16()
+	if !ok {
+		return val, errUnexpectedEnd
+	}
+	if idx >= len(i.consts) || i.consts[idx].kind != kind {
+		return val, fmt.Errorf("Invalid constant: %d", idx)
+	}
+	return i.consts[idx], nil
+}
+
+// readOffset reads the offset of a variable.
+func (i *interpreter) readOffset() (n int, err error) {
+	x, ok := i.code.ReadVarint()
+	if !ok {
+		return 0, errUnexpectedEnd
+	}
+	return int(x), nil
+}
+
+// readCount reads a number of arguments or an index of a global.
+func (i *interpreter) readCount() (n int, err error) {
+	x, ok := i.code.ReadUvarint()
+	if !ok {
+		return 0, errUnexpectedEnd
+	}
+	if x > math.MaxInt32 {
+		return 0, fmt.Errorf("Invalid operand: %d", x)
+	}
+	return int(x), nil
+}
+
+// readAddr reads the address of a jump.
+func (i *interpreter) readAddr() (addr int, err error) {
+	var ok bool
+	if addr, ok = i.code.ReadU32(); !ok {
+		return 0, errUnexpectedEnd
+	}
 	return
 }
@@ -1,4 +1,4 @@
-package main
+package popi
 
 import (
 	"fmt"
@@ -8,35 +8,539 @@ import (
 
 func TestIntExpr(t *testing.T) {
 	i := exec(t, "1 + 2 * 3 - 4 / 2")
-	checkEqualInt(t, 5, i.Pop().(int))
-	checkNil(t, i.Pop())
+	checkEqualInt(t, 5, i.popGo().(int))
+	checkNil(t, i.popGo())
 }
 
 func TestIntExprListSemiColon(t *testing.T) {
 	i := exec(t, "1 + 2 * 3 - 4 / 2 ; 4 * 5")
-	checkEqualInt(t, 20, i.Pop().(int))
-	checkNil(t, i.Pop())
+	checkEqualInt(t, 20, i.popGo().(int))
+	checkNil(t, i.popGo())
 }
 
 func TestIntExprListNewLine(t *testing.T) {
 	i := exec(t, "1 + 2 * 3 - 4 / 2 \n  4 * 5")
-	checkEqualInt(t, 20, i.Pop().(int))
-	checkNil(t, i.Pop())
+	checkEqualInt(t, 20, i.popGo().(int))
+	checkNil(t, i.popGo())
+}
+
+func TestOperators(t *testing.T) {
+	checkEval(t, []evalTest{
+		{"(1 + 2) * 3", 9},
+		{"2 * (3 + 4) - (5 - 1) / 2", 12},
+		{"((7))", 7},
+		{"7 % 3", 1},
+		{"-7 % 3", -1},
+		{"7.5 % 2", 1.5},
+		{"7 % 2.5", 2.0},
+		{"2 ** 10", 1024},
+		{"2 ** 0", 1},
+		{"2 ** 3 ** 2", 512},
+		{"2.0 ** -1", 0.5},
+		{"4 ** 0.5", 2.0},
+		{"-2 ** 2", -4},
+		{"(-2) ** 2", 4},
+		{"let x = 3; -x * 2", -6},
+		{"let x = 1.5; -x", -1.5},
+		{"let x = 3; +x", 3},
+		{"let x = 3; - -x", 3},
+		{"let x = 3; 10 - -x", 13},
+		{"let x = 3; x % 2 == 1", true},
+		{"let x = 2; x ** x ** x", 16},
+		{"let x = true; !x", false},
+		{"let x = 1; !(x > 2)", true},
+		{"let f = fn(a, b) { a % b }; f(7.5, 2)", 1.5},
+		{"let f = fn(a, b) { a ** b }; f(3, 3)", 27},
+		{"let f = fn(a) { -a }; f(2.5)", -2.5},
+		{"let f = fn(a) { +a }; f(2.5)", 2.5},
+		{"let f = fn(a) { !a }; f(false)", true},
+	})
 }
 
 func TestVarAssign(t *testing.T) {
-	i := exec(t, "x = 7")
-	checkEqualInt(t, 7, i.Pop().(int))
-	checkEqualInt(t, 7, i.Pop().(int))
-	checkNil(t, i.Pop())
+	i := exec(t, "let x = 7")
+	checkEqualInt(t, 7, i.popGo().(int))
+	checkEqualInt(t, 7, i.popGo().(int))
+	checkNil(t, i.popGo())
 }
 
 func TestVarEval(t *testing.T) {
-	i := exec(t, "x = 7; x + 2; y = 8; x + y")
-	checkEqualInt(t, 15, i.Pop().(int))
-	checkEqualInt(t, 8, i.Pop().(int))
-	checkEqualInt(t, 7, i.Pop().(int))
-	checkNil(t, i.Pop())
+	i := exec(t, "let x = 7; x + 2; let y = 8; x + y")
+	checkEqualInt(t, 15, i.popGo().(int))
+	checkEqualInt(t, 8, i.popGo().(int))
+	checkEqualInt(t, 7, i.popGo().(int))
+	checkNil(t, i.popGo())
+}
+
+func TestVarUpdate(t *testing.T) {
+	checkEval(t, []evalTest{
+		{"var x = 1; x = 2; x", 2},
+		{"let x = 1; let y = x = 5; x + y", 10},
+		{"var s = 0; for i in 0..5 { s = s + i }; s", 10},
+		{"var n = 0; while n < 5 { n = n + 1 }; n", 5},
+		{"var n = 0; if true { n = 3; let n = 4; n = 5 }; n", 3},
+		// the type of a variable assigned is not known
+		{"var x = 1; x = 1.5; x + 1", 2.5},
+		{"var x = 1; for i in 0..2 { x = x * 1.5 }; x", 2.25},
+		{`var x = 1; x = "a"; x`, "a"},
+		{"var s = 0; for i in 0..10 { s = s + i; i = i + 1 }; s", 20},
+		{"let f = fn(a) { a = a * 2; a }; f(4)", 8},
+		{"let make = fn() { var n = 0; fn() { n = n + 1 } }; let c = make(); c(); c(); c()", 3},
+		{"var n = 0; let inc = fn() { n = n + 1 }; inc(); inc(); n", 2},
+		{"const k = 3; k * 2", 6},
+	})
+}
+
+func TestFuncDef(t *testing.T) {
+	i := exec(t, "let f = fn(a, b) { a / b }")
+	i.popGo()
+	i.popGo()
+	checkNil(t, i.popGo())
+}
+
+func TestFuncCall(t *testing.T) {
+	i := exec(t, "let f = fn(a, b) { a - b }; f(7, 2)")
+	checkEqualInt(t, 5, i.popGo().(int))
+	i.popGo()
+	checkNil(t, i.popGo())
+}
+
+func TestFuncLocalVar(t *testing.T) {
+	i := exec(t, `let f = fn(a) {
+		let b = a * 2
+		b + 1
+	}
+	let x = 4
+	f(x) + f(1)`)
+	checkEqualInt(t, 12, i.popGo().(int))
+	checkEqualInt(t, 4, i.popGo().(int))
+	i.popGo()
+	checkNil(t, i.popGo())
+}
+
+func TestFuncNoParams(t *testing.T) {
+	i := exec(t, "let f = fn() { 3 }; f() * f()")
+	checkEqualInt(t, 9, i.popGo().(int))
+	i.popGo()
+	checkNil(t, i.popGo())
+}
+
+func TestCompare(t *testing.T) {
+	i := exec(t, "1 + 1 == 2; 1 != 1; 2 < 3; 3 <= 3; 2 > 3; 2 >= 3")
+	checkEqualBool(t, false, i.popGo().(bool))
+	checkNil(t, i.popGo())
+	i = exec(t, "let x = 2 < 3; x == true")
+	checkEqualBool(t, true, i.popGo().(bool))
+	checkEqualBool(t, true, i.popGo().(bool))
+	checkNil(t, i.popGo())
+}
+
+func TestIf(t *testing.T) {
+	i := exec(t, "let x = 5; if x > 3 { x * 2 } else { x }")
+	checkEqualInt(t, 10, i.popGo().(int))
+	i.popGo()
+	checkNil(t, i.popGo())
+	i = exec(t, "let x = 2; if x > 3 { x * 2 } else { x }")
+	checkEqualInt(t, 2, i.popGo().(int))
+}
+
+func TestIfElseIf(t *testing.T) {
+	i := exec(t, `let sign = fn(n) {
+		if n < 0 { 0 - 1 } else if n == 0 { 0 } else { 1 }
+	}
+	sign(0 - 5) * 100 + sign(0) * 10 + sign(7)`)
+	checkEqualInt(t, -99, i.popGo().(int))
+}
+
+func TestIfWithoutElse(t *testing.T) {
+	i := exec(t, "if 1 > 2 { 3 }")
+	checkNilValue(t, i.popGo())
+	checkNil(t, i.popGo())
+}
+
+func TestIfBlockVars(t *testing.T) {
+	i := exec(t, `let x = 1
+	let y = if x == 1 {
+		let a = 10
+		let b = 20
+		a + b
+	} else {
+		0
+	}
+	let z = 3
+	x + y + z`)
+	checkEqualInt(t, 34, i.popGo().(int))
+	checkEqualInt(t, 3, i.popGo().(int))
+	checkEqualInt(t, 30, i.popGo().(int))
+	checkEqualInt(t, 1, i.popGo().(int))
+	checkNil(t, i.popGo())
+}
+
+func TestBlockLocalValue(t *testing.T) {
+	checkEval(t, []evalTest{
+		{"let r = if true { let t = 5; t } else { 0 }; r", 5},
+		{"let a = 1; let b = 2; if a < b { let t = a; t } else { b }", 1},
+		{"let x = 1; if x > 0 { let y = x + 1; let z = y * 2; z }", 4},
+		{"let f = fn(a) { if a > 0 { let t = a * 2; t } else { 0 } }; f(3)", 6},
+		{"var s = 0; for i in 0..3 { let t = i; s = s + t }; s", 3},
+	})
+}
+
+func TestFor(t *testing.T) {
+	i := exec(t, "let x = 3; for i in 1..x + 2 { i * 10 }; x")
+	checkEqualInt(t, 3, i.popGo().(int))
+	checkEqualInt(t, 3, i.popGo().(int))
+	checkNil(t, i.popGo())
+	i = exec(t, "for i in 1..5 { i * 10 }")
+	checkEqualInt(t, 40, i.popGo().(int))
+	checkNil(t, i.popGo())
+	i = exec(t, "for i in 5..1 { i }")
+	checkNilValue(t, i.popGo())
+	checkNil(t, i.popGo())
+}
+
+func TestForNested(t *testing.T) {
+	i := exec(t, "for i in 0..3 { for j in 0..4 { i * 10 + j } }")
+	checkEqualInt(t, 23, i.popGo().(int))
+	checkNil(t, i.popGo())
+}
+
+func TestBreak(t *testing.T) {
+	i := exec(t, `for i in 0..100 {
+		let a = i * 2
+		if a > 10 { let b = 1; break }
+		a
+	}`)
+	checkEqualInt(t, 10, i.popGo().(int))
+	checkNil(t, i.popGo())
+}
+
+func TestContinue(t *testing.T) {
+	i := exec(t, `for i in 0..10 {
+		let a = i
+		if a > 3 { continue }
+		a
+	}`)
+	checkEqualInt(t, 3, i.popGo().(int))
+	checkNil(t, i.popGo())
+}
+
+func TestWhile(t *testing.T) {
+	i := exec(t, "while true { let x = 1; break }; 2")
+	checkEqualInt(t, 2, i.popGo().(int))
+	checkNil(t, i.popGo())
+	i = exec(t, "while 1 > 2 { 1 }")
+	checkNilValue(t, i.popGo())
+	checkNil(t, i.popGo())
+	i = exec(t, "for i in 0..5 { while i < 3 { if i == 2 { break } else { i }; break } }")
+	checkNilValue(t, i.popGo())
+	checkNil(t, i.popGo())
+}
+
+func TestLoopInFunc(t *testing.T) {
+	i := exec(t, `let last = fn(n) {
+		for i in 0..n { if i * i > n { break }; i }
+	}
+	last(20)`)
+	checkEqualInt(t, 4, i.popGo().(int))
+}
+
+func TestClosure(t *testing.T) {
+	i := exec(t, `let adder = fn(n) { fn(x) { x + n } }
+	let add2 = adder(2)
+	let add10 = adder(10)
+	add2(1) * 100 + add10(1)`)
+	checkEqualInt(t, 311, i.popGo().(int))
+}
+
+func TestClosureCallback(t *testing.T) {
+	i := exec(t, `let apply = fn(f, n) { f(n) }
+	let sum = fn(a, b) {
+		let k = b - a
+		apply(fn(x) { x * k + a }, 3)
+	}
+	sum(1, 5)`)
+	checkEqualInt(t, 13, i.popGo().(int))
+}
+
+func TestClosureNested(t *testing.T) {
+	// c is captured by the innermost function through the middle one
+	i := exec(t, `let c = 100
+	let f = fn(a) { fn(b) { fn() { a + b + c } } }
+	f(1)(20)() + f(2)(30)()`)
+	checkEqualInt(t, 253, i.popGo().(int))
+}
+
+func TestClosureLoop(t *testing.T) {
+	// each iteration captures its own counter
+	i := exec(t, `let fs = fn(n) {
+		for i in 0..n { if i == 3 { break }; let f = fn() { i * 10 }; let g = fn() { i }; f }
+	}
+	fs(5)()`)
+	checkEqualInt(t, 20, i.popGo().(int))
+}
+
+func TestClosureEqual(t *testing.T) {
+	i := exec(t, `let f = fn(n) { fn() { n } }; let g = f(1); let h = g; g == h`)
+	checkEqualBool(t, true, i.popGo().(bool))
+	i = exec(t, `let f = fn(n) { fn() { n } }; f(1) == f(1)`)
+	checkEqualBool(t, false, i.popGo().(bool))
+}
+
+func TestRecursion(t *testing.T) {
+	i := exec(t, `let fib = fn(n) { if n < 2 { n } else { fib(n - 1) + fib(n - 2) } }
+	fib(15)`)
+	checkEqualInt(t, 610, i.popGo().(int))
+	// the function in a block refers to itself, not to the outer variable
+	i = exec(t, `let f = 1; if true { let f = fn(n) { if n == 0 { 1 } else { n * f(n - 1) } }; f(5) }`)
+	checkEqualInt(t, 120, i.popGo().(int))
+}
+
+func TestReturn(t *testing.T) {
+	i := exec(t, `let root = fn(n) {
+		for i in 0..n {
+			if i * i > n { return i - 1 }
+		}
+		n
+	}
+	root(20) * 10 + root(1)`)
+	checkEqualInt(t, 41, i.popGo().(int))
+	src := "let f = fn(x) { while true { if x > 0 { let b = x * 2; return b + 1 } else { return } } }; "
+	i = exec(t, src+"f(3)")
+	checkEqualInt(t, 7, i.popGo().(int))
+	i = exec(t, src+"f(0)")
+	checkNilValue(t, i.popGo())
+}
+
+func TestTailCall(t *testing.T) {
+	i := exec(t, `let count = fn(n, acc) {
+		if n == 0 { return acc }
+		let b = n - 1
+		count(b, acc + 1)
+	}
+	count(1000000, 0)`)
+	checkEqualInt(t, 1000000, i.popGo().(int))
+	// the frames of the calls are replaced
+	checkEqualInt(t, 1<<6, len(i.callStack))
+	checkEqualInt(t, 1<<8, len(i.dataStack))
+	i = exec(t, `let down = fn(n) { if n > 0 { return down(n - 1) } else { "done" } }
+	down(1000000)`)
+	checkEqualString(t, "done", i.popGo().(string))
+	checkEqualInt(t, 1<<6, len(i.callStack))
+}
+
+func TestFloatLiteral(t *testing.T) {
+	tests := []struct {
+		src string
+		val float64
+	}{
+		{"3.14", 3.14},
+		{"1e-9", 1e-9},
+		{".5", 0.5},
+		{"2.5E3", 2500},
+		{"1e+2", 100},
+		{"0.0", 0},
+	}
+	for _, test := range tests {
+		i := exec(t, test.src)
+		checkEqualFloat(t, test.val, i.popGo().(float64))
+		checkNil(t, i.popGo())
+	}
+}
+
+func TestRangeAfterInt(t *testing.T) {
+	i := exec(t, "for i in 1..3 { i }")
+	checkEqualInt(t, 2, i.popGo().(int))
+}
+
+func TestMixedArith(t *testing.T) {
+	checkEval(t, []evalTest{
+		{"7 + 2", 9},
+		{"7 - 2", 5},
+		{"7 * 2", 14},
+		{"7 / 2", 3},
+		{"7.0 + 2.0", 9.0},
+		{"7.0 - 2.0", 5.0},
+		{"7.0 * 2.0", 14.0},
+		{"7.0 / 2.0", 3.5},
+		{"7 + 2.5", 9.5},
+		{"7 - 2.5", 4.5},
+		{"7 * 2.5", 17.5},
+		{"7 / 2.5", 2.8},
+		{"7.5 + 2", 9.5},
+		{"7.5 - 2", 5.5},
+		{"7.5 * 2", 15.0},
+		{"7.5 / 2", 3.75},
+		{"let f = fn(a, b) { a + b }; f(7, 2)", 9},
+		{"let f = fn(a, b) { a / b }; f(7, 2.0)", 3.5},
+		{"let f = fn(a, b) { a * b }; f(1.5, 2)", 3.0},
+		{"let f = fn(a, b) { a - b }; f(1.5, 0.5)", 1.0},
+		{"let x = 1.5; let y = 2; x * y + y", 5.0},
+	})
+}
+
+func TestMixedCompare(t *testing.T) {
+	tests := []struct {
+		src string
+		val bool
+	}{
+		{"1 == 1.0", true},
+		{"1.5 != 1", true},
+		{"1 < 1.5", true},
+		{"2.5 <= 2", false},
+		{"3.0 > 2", true},
+		{"2 >= 2.0", true},
+		{"0.1 + 0.2 == 0.3", false},
+	}
+	for _, test := range tests {
+		i := exec(t, test.src)
+		checkEqualBool(t, test.val, i.popGo().(bool))
+	}
+}
+
+func TestTypedOps(t *testing.T) {
+	tests := []struct {
+		src string
+		op  opCode
+	}{
+		{"let x = 1; x + 2", opAddI},
+		{"let x = 1.0; x - 2.0", opSubF},
+		{"let x = 1.0; x * 2.0", opMulF},
+		{"let x = 1; x / 2.0", opDiv},
+		{"let x = if true { 1 } else { 1.0 }; x + 1", opAdd},
+		{"let x = 7; x % 2", opModI},
+		{"let x = 2.0; x ** 0.5", opPowF},
+		{"let x = 2; x ** 0.5", opPow},
+		{"let x = 1; -x", opNeg},
+		{"let x = true; !x", opNot},
+	}
+	for _, test := range tests {
+		code := compile(t, test.src).code
+		if op := opCode(code[len(code)-1]); op != test.op {
+			t.Fatalf("%s: %s: expected %s, actual %s", t.Name(), test.src, test.op, op)
+		}
+	}
+}
+
+func TestConstPool(t *testing.T) {
+	prog := compile(t, `let s = "abc"; s + "abc"; let x = 1; x + 1; 1.5; let f = fn() { 1 }; let g = fn() { 1 }`)
+	checkEqualInt(t, 5, len(prog.consts))
+	// pushi 0, dup, drop, get 0, pushi 1, addi
+	checkEqualInt(t, 11, len(compile(t, "let x = 1; x + 2").code))
+}
+
+func TestStringLiteral(t *testing.T) {
+	tests := []struct {
+		src string
+		val string
+	}{
+		{`"hello"`, "hello"},
+		{`""`, ""},
+		{`"a\nb\tc"`, "a\nb\tc"},
+		{`"say \"hi\" \\o/"`, `say "hi" \o/`},
+		{`"\u{48}\u{e9}\u{1F600}"`, "H\u00e9\U0001F600"},
+	}
+	for _, test := range tests {
+		i := exec(t, test.src)
+		checkEqualString(t, test.val, i.popGo().(string))
+		checkNil(t, i.popGo())
+	}
+}
+
+func TestStringLiteralError(t *testing.T) {
+	for _, src := range []string{`"abc`, `"a\qb"`, `"\u{110000}"`, `"\u{41"`, `"\u41"`, "\"a\nb\""} {
+		p := newParser(strings.NewReader(src))
+		if _, err := p.Parse(); err == nil {
+			t.Fatalf("%s: %s: expected error", t.Name(), src)
+		}
+	}
+}
+
+func TestStringOps(t *testing.T) {
+	i := exec(t, `let greet = fn(name) { "Hello, " + name + "!" }; greet("popi")`)
+	checkEqualString(t, "Hello, popi!", i.popGo().(string))
+	i = exec(t, `let s = "h\u{e9}llo"; len(s) + len("")`)
+	checkEqualInt(t, 5, i.popGo().(int))
+	i = exec(t, `"abc" == "abc"; "abc" != "abd"`)
+	checkEqualBool(t, true, i.popGo().(bool))
+	i = exec(t, `"abc" < "abd"`)
+	checkEqualBool(t, true, i.popGo().(bool))
+	i = exec(t, `"b" <= "abc"`)
+	checkEqualBool(t, false, i.popGo().(bool))
+	i = exec(t, `"1" == 1`)
+	checkEqualBool(t, false, i.popGo().(bool))
+}
+
+func TestRuntimeError(t *testing.T) {
+	tests := []struct {
+		src string
+		op  opCode
+		msg string
+	}{
+		{"1 / 0", opDivI, "Division by zero"},
+		{"let f = fn(a, b) { a / b }; f(1, 0)", opDiv, "Division by zero"},
+		{"1 + true", opAdd, "Unexpected value: bool, number expected"},
+		{`"a" - 1`, opSub, "Unexpected value: string, number expected"},
+		{`"a" + 1`, opAdd, "Unexpected value: int, string expected"},
+		{`"a" < 1`, opLt, "Unexpected value: int, string expected"},
+		{`len(1)`, opLen, "Unexpected value: int, string expected"},
+		{"let x = true; x()", opCall, "Unexpected value: bool, function expected"},
+		{"let f = fn(a) { a }; f(1, 2)", opCall, "Wrong number of arguments: 2, 1 expected"},
+		{"if 1 { 2 }", opJmpF, "Unexpected value: int, bool expected"},
+		{"7 % 0", opModI, "Division by zero"},
+		{"let f = fn(a, b) { a % b }; f(1, 0)", opMod, "Division by zero"},
+		{"2 ** -1", opPowI, "Negative exponent of int"},
+		{"let f = fn(a, b) { a ** b }; f(2, -1)", opPow, "Negative exponent of int"},
+		{`-"a"`, opNeg, "Unexpected value: string, number expected"},
+		{"!1", opNot, "Unexpected value: int, bool expected"},
+		{"let f = fn(n) { f(n + 1) + 1 }; f(0)", opCall, "Stack overflow"},
+		// the frames hold more values than the calls
+		{"let f = fn() { " + strings.Repeat("let x = 0; ", 20) + "f() + x }; f()", opCall, "Stack overflow"},
+		{`+"a"`, opPos, "Unexpected value: string, number expected"},
+		{"+true", opPos, "Unexpected value: bool, number expected"},
+		{`let f = fn(a) { +a }; f("a")`, opPos, "Unexpected value: string, number expected"},
+	}
+	for _, test := range tests {
+		err := execError(t, compile(t, test.src))
+		if err.op != test.op || err.Msg() != test.msg {
+			t.Fatalf("%s: %s: unexpected error: %s", t.Name(), test.src, err)
+		}
+	}
+}
+
+func TestRuntimeErrorBadCode(t *testing.T) {
+	tests := []struct {
+		code []byte
+		addr int
+		msg  string
+	}{
+		{[]byte{255}, 0, "Unknown opcode: 255"},
+		{[]byte{opPushI, 1}, 0, "Unexpected end of code"},
+		{[]byte{opPushI, 1, 0}, 0, "Invalid constant: 1"},
+		{[]byte{opTrue, opDrop, opDrop}, 2, "Stack underflow"},
+		{[]byte{opTrue, opSwap}, 1, "Stack underflow"},
+		{[]byte{opNil, opRet}, 1, "Return outside of function"},
+		{[]byte{opGet, 6}, 0, "Invalid variable offset: 3"},
+		{[]byte{opGet, 0x80}, 0, "Unexpected end of code"},
+		{[]byte{opCall, 0x80, 0x80, 0x80, 0x80, 0x08}, 0, "Invalid operand: 2147483648"},
+		{[]byte{opJmp, 100, 0, 0, 0}, 0, "Invalid address: 100"},
+	}
+	for _, test := range tests {
+		err := execError(t, &Program{code: test.code})
+		if err.Addr() != test.addr || err.Msg() != test.msg {
+			t.Fatalf("%s: %v: unexpected error: %s", t.Name(), test.code, err)
+		}
+	}
+}
+
+func TestStackGrowth(t *testing.T) {
+	var sb strings.Builder
+	for n := 0; n < 1000; n++ {
+		fmt.Fprintf(&sb, "let x%d = %d; ", n, n)
+	}
+	sb.WriteString("x0 + x999")
+	i := exec(t, sb.String())
+	checkEqualInt(t, 999, i.popGo().(int))
 }
 
 func checkEqualInt(t *testing.T, expected int, actual int) {
@@ -45,21 +549,123 @@ func checkEqualInt(t *testing.T, expected int, actual int) {
 	}
 }
 
+func checkEqualFloat(t *testing.T, expected float64, actual float64) {
+	if actual != expected {
+		t.Fatal(fmt.Sprintf("%s: expected %g, actual %g", t.Name(), expected, actual))
+	}
+}
+
+func checkEqualString(t *testing.T, expected string, actual string) {
+	if actual != expected {
+		t.Fatal(fmt.Sprintf("%s: expected %q, actual %q", t.Name(), expected, actual))
+	}
+}
+
+func checkEqualBool(t *testing.T, expected bool, actual bool) {
+	if actual != expected {
+		t.Fatal(fmt.Sprintf("%s: expected %t, actual %t", t.Name(), expected, actual))
+	}
+}
+
 func checkNil(t *testing.T, val interface{}) {
 	if val != nil {
 		t.Fatal(fmt.Sprintf("%s: expected nil, actual %v", t.Name(), val))
 	}
 }
 
-func exec(t *testing.T, s string) (i *Interpreter) {
-	p := NewParser(strings.NewReader(s))
-	code, err := p.Parse()
+func checkNilValue(t *testing.T, val interface{}) {
+	if _, ok := val.(Nil); !ok {
+		t.Fatal(fmt.Sprintf("%s: expected nil value, actual %v", t.Name(), val))
+	}
+}
+
+func compile(t *testing.T, s string) (prog *Program) {
+	p := newParser(strings.NewReader(s))
+	prog, err := p.Parse()
 	if err != nil {
 		t.Fatal(err)
 	}
-	i = NewInterpreter(code)
-	if err := i.Exec(); err != nil {
+	if err = Verify(prog); err != nil {
+		t.Fatalf("%s: %v", t.Name(), err)
+	}
+	return
+}
+
+// evalTest is a source and the value it leaves on the stack.
+type evalTest struct {
+	src string
+	val interface{}
+}
+
+// checkEval runs the sources of the tests by exec and checks their values.
+func checkEval(t *testing.T, tests []evalTest) {
+	for _, test := range tests {
+		checkPop(t, test.src, exec(t, test.src), test.val)
+	}
+}
+
+// checkPop checks the value on the top of the stack left by the source.
+func checkPop(t *testing.T, src string, i *interpreter, expected interface{}) {
+	if val := i.popGo(); val != expected {
+		t.Fatalf("%s: %s: expected %v (%T), actual %v (%T)", t.Name(), src, expected, expected, val, val)
+	}
+}
+
+func execError(t *testing.T, prog *Program) *RuntimeError {
+	err := newInterpreter(prog).exec()
+	if err == nil {
+		t.Fatalf("%s: expected runtime error", t.Name())
+	}
+	rerr, ok := err.(*RuntimeError)
+	if !ok {
+		t.Fatalf("%s: unexpected error: %s", t.Name(), err)
+	}
+	return rerr
+}
+
+// exec runs the source compiled as by Compile, i.e. with the peephole
+// optimizer, which compile leaves out. The optimized code is verified.
+func exec(t *testing.T, s string) (i *interpreter) {
+	prog, err := Compile(s, nil)
+	if err != nil {
 		t.Fatal(err)
 	}
+	if err = Verify(prog); err != nil {
+		t.Fatalf("%s: %s: %v", t.Name(), s, err)
+	}
+	i = newInterpreter(prog)
+	if err = i.exec(); err != nil {
+		t.Fatalf("%s: %s: %v", t.Name(), s, err)
+	}
 	return
 }
+
+func benchmarkExec(b *testing.B, src string) {
+	prog, err := newParser(strings.NewReader(src)).Parse()
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if err := newInterpreter(prog).exec(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkIntArith(b *testing.B) {
+	benchmarkExec(b, "var s = 0; for i in 0..1000 { s = s + i * 2 - i / 3 }; s")
+}
+
+func BenchmarkFloatArith(b *testing.B) {
+	benchmarkExec(b, "var x = 0.5; for i in 0..1000 { x = x * 1.0001 + 0.25 }; x")
+}
+
+func BenchmarkMixedArith(b *testing.B) {
+	benchmarkExec(b, "let f = fn(a, b) { a * b + 1 }; var s = 0; for i in 0..1000 { s = f(s, 0.5) + i }; s")
+}
+
+func BenchmarkSmallEval(b *testing.B) {
+	benchmarkExec(b, "let a = 12; let b = 30; if a * 3 > b { a + b } else { a - b }")
+}
@@ -1,134 +1,182 @@
-package main
+package popi
 
 import (
 	"fmt"
 	"io"
+	"strconv"
+	"strings"
 	"unicode"
+	"unicode/utf8"
 )
 
+const eof = -1
+
 type LexerError struct {
-	line int
-	pos  int
+	span Span
 	msg  string
 }
 
 func (err *LexerError) Error() string {
-	return fmt.Sprintf("%s at line %d and position %d", err.msg, err.line, err.pos)
+	return fmt.Sprintf("%s at line %d and position %d", err.msg, err.span.Start.Line, err.span.Start.Col)
 }
 
 func (err *LexerError) Line() int {
-	return err.line
+	return err.span.Start.Line
 }
 
 func (err *LexerError) Pos() int {
-	return err.pos
+	return err.span.Start.Col
+}
+
+func (err *LexerError) Span() Span {
+	return err.span
 }
 
 func (err *LexerError) Msg() string {
 	return err.msg
 }
 
-type Lexer struct {
-	rs   io.RuneScanner
-	line int
-	pos  int
-	tok  Token
+type lexer struct {
+	rs    io.RuneScanner
+	line  int
+	pos   int
+	tok   token
+	back  []rune // runes read ahead and returned back
+	hist  []Pos  // positions of the recently read runes
+	start Pos    // start of the token being read
 }
 
-func NewLexer(rs io.RuneScanner) *Lexer {
-	return &Lexer{rs, 1, 1, Token{}}
+// maxHist is the number of runes which can be returned back.
+const maxHist = 4
+
+func newLexer(rs io.RuneScanner) *lexer {
+	return &lexer{rs, 1, 1, token{}, nil, nil, Pos{1, 1}}
 }
 
-func (l *Lexer) ReadToken() (tok Token, err error) {
-	if l.tok.id > TokNone {
-		tok, l.tok = l.tok, Token{}
+func (l *lexer) ReadToken() (tok token, err error) {
+	if l.tok.id > tokNone {
+		tok, l.tok = l.tok, token{}
 		return
 	}
+	defer func() {
+		tok.span = Span{l.start, l.position()}
+	}()
 	if err = l.skipSpace(); err != nil {
+		l.start = l.position()
 		if err == io.EOF {
-			tok = Token{id: TokEOF}
+			tok = token{id: tokEOF}
 			err = nil
 		}
 		return
 	}
+	l.start = l.position()
 	r, err := l.readRune()
 	if err != nil {
 		if err == io.EOF {
-			tok = Token{id: TokEOF}
+			tok = token{id: tokEOF}
 			err = nil
 		}
 		return
 	}
 	switch r {
 	case '+':
-		tok = Token{id: TokAdd}
+		tok = token{id: tokAdd}
 	case '-':
-		tok = Token{id: TokSub}
+		tok = token{id: tokSub}
 	case '*':
-		tok = Token{id: TokMul}
+		tok, err = l.readOp('*', tokMul, tokPow)
 	case '/':
-		tok = Token{id: TokDiv}
+		tok = token{id: tokDiv}
+	case '%':
+		tok = token{id: tokMod}
 	case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
-		if err = l.rs.UnreadRune(); err != nil {
-			return
-		}
-		tok = Token{id: TokInt}
-		if tok.val, err = l.readNum(); err != nil {
-			return
-		}
+		l.unreadRune(r)
+		tok, err = l.readNum()
 	case '(':
-		tok = Token{id: TokLParen}
+		tok = token{id: tokLParen}
 	case ')':
-		tok = Token{id: TokRParen}
+		tok = token{id: tokRParen}
 	case '{':
-		tok = Token{id: TokLBrace}
+		tok = token{id: tokLBrace}
 	case '}':
-		tok = Token{id: TokRBrace}
+		tok = token{id: tokRBrace}
+	case '[':
+		tok = token{id: tokLBracket}
+	case ']':
+		tok = token{id: tokRBracket}
 	case ',':
-		tok = Token{id: TokComma}
+		tok = token{id: tokComma}
 	case ';':
-		tok = Token{id: TokSColon}
+		tok = token{id: tokSColon}
 	case '\n':
-		tok = Token{id: TokSColon} // implicit semicolon
+		tok = token{id: tokSColon} // implicit semicolon
 	case '=':
-		if r, err = l.readRune(); err != nil {
+		tok, err = l.readOp('=', tokAssign, tokEqual)
+	case '<':
+		tok, err = l.readOp('=', tokLess, tokLessEqual)
+	case '>':
+		tok, err = l.readOp('=', tokGreater, tokGreaterEqual)
+	case '.':
+		var next rune
+		if next, err = l.peekRune(); err != nil {
 			return
 		}
-		if r == '=' {
-			tok = Token{id: TokEqual}
-		} else {
-			tok = Token{id: TokAssign}
-			if err = l.rs.UnreadRune(); err != nil {
-				return
-			}
+		if isDigit(next) {
+			l.unreadRune(r)
+			tok, err = l.readNum()
+			break
 		}
+		tok, err = l.readOp('.', tokDot, tokRange)
+	case '"':
+		tok = token{id: tokString}
+		tok.val, err = l.readString()
+	case '!':
+		tok, err = l.readOp('=', tokNot, tokNotEqual)
 	default:
-		if err = l.rs.UnreadRune(); err != nil {
-			return
-		}
+		l.unreadRune(r)
 		var val string
 		if val, err = l.readIdent(); err != nil {
 			return
 		}
-		if val == "fn" {
-			tok = Token{id: TokFn, val: val}
+		if id, ok := keywords[val]; ok {
+			tok = token{id: id, val: val}
 		} else {
-			tok = Token{id: TokIdent, val: val}
+			tok = token{id: tokIdent, val: val}
 		}
 	}
 
 	return
 }
 
-func (l *Lexer) UnreadToken(tok Token) (err error) {
-	if l.tok.id > TokNone {
+// readOp reads an operator which is either single char (id) or followed
+// by the next char (id2).
+func (l *lexer) readOp(next rune, id int, id2 int) (tok token, err error) {
+	var r rune
+	if r, err = l.readRune(); err != nil {
+		if err == io.EOF {
+			tok = token{id: id}
+			err = nil
+		}
+		return
+	}
+	if r == next {
+		tok = token{id: id2}
+		return
+	}
+	tok = token{id: id}
+	l.unreadRune(r)
+	return
+}
+
+func (l *lexer) UnreadToken(tok token) (err error) {
+	if l.tok.id > tokNone {
 		return l.makeError("Cannot unread token")
 	}
 	l.tok = tok
 	return
 }
 
-func (l *Lexer) skipSpace() (err error) {
+func (l *lexer) skipSpace() (err error) {
 	var r rune
 	for {
 		r, err = l.readRune()
@@ -136,47 +184,205 @@ func (l *Lexer) skipSpace() (err error) {
 			return
 		}
 		if !unicode.IsSpace(r) || r == '\n' {
-			return l.rs.UnreadRune()
+			l.unreadRune(r)
+			return
 		}
 	}
 }
 
-func (l *Lexer) readRune() (r rune, err error) {
-	if r, _, err = l.rs.ReadRune(); err != nil {
+func (l *lexer) readRune() (r rune, err error) {
+	if n := len(l.back); n > 0 {
+		r, l.back = l.back[n-1], l.back[:n-1]
+	} else if r, _, err = l.rs.ReadRune(); err != nil {
 		return
 	}
+	if len(l.hist) == maxHist {
+		copy(l.hist, l.hist[1:])
+		l.hist = l.hist[:maxHist-1]
+	}
+	l.hist = append(l.hist, l.position())
 	if r == '\n' {
 		l.line++
 		l.pos = 1
+	} else {
+		l.pos++
+	}
+	return
+}
+
+// unreadRune returns the rune back, so it is read again by readRune.
+// Unlike io.RuneScanner more runes can be returned, up to maxHist.
+func (l *lexer) unreadRune(r rune) {
+	l.back = append(l.back, r)
+	n := len(l.hist) - 1
+	l.line, l.pos = l.hist[n].Line, l.hist[n].Col
+	l.hist = l.hist[:n]
+}
+
+// position returns the position of the next rune.
+func (l *lexer) position() Pos {
+	return Pos{l.line, l.pos}
+}
+
+// peekRune returns the next rune without consuming it, or eof at the end
+// of input.
+func (l *lexer) peekRune() (r rune, err error) {
+	if r, err = l.readRune(); err != nil {
+		if err == io.EOF {
+			r, err = eof, nil
+		}
+		return
+	}
+	l.unreadRune(r)
+	return
+}
+
+// readNum reads an integer or a floating point number. The fraction may be
+// omitted before the exponent (1e9) and the integer part before the
+// decimal point (.5). A point not followed by a digit is left for the
+// range operator (1..5).
+func (l *lexer) readNum() (tok token, err error) {
+	var (
+		sb strings.Builder
+		r  rune
+	)
+	tok.id = tokInt
+	if err = l.readDigits(&sb); err != nil {
+		return
+	}
+	if r, err = l.peekRune(); err != nil {
+		return
+	}
+	if r == '.' {
+		l.readRune()
+		if r, err = l.peekRune(); err != nil {
+			return
+		}
+		if isDigit(r) {
+			tok.id = tokFloat
+			sb.WriteRune('.')
+			if err = l.readDigits(&sb); err != nil {
+				return
+			}
+		} else {
+			l.unreadRune('.')
+		}
+	}
+	if r, err = l.peekRune(); err != nil {
+		return
+	}
+	if r == 'e' || r == 'E' {
+		tok.id = tokFloat
+		l.readRune()
+		sb.WriteRune('e')
+		if r, err = l.peekRune(); err != nil {
+			return
+		}
+		if r == '+' || r == '-' {
+			l.readRune()
+			sb.WriteRune(r)
+		}
+		n := sb.Len()
+		if err = l.readDigits(&sb); err != nil {
+			return
+		}
+		if sb.Len() == n {
+			return tok, l.makeError("Malformed number: %s", sb.String())
+		}
+	}
+	if tok.id == tokInt {
+		if tok.val, err = strconv.Atoi(sb.String()); err != nil {
+			err = l.makeError("Invalid integer: %s", sb.String())
+		}
+	} else {
+		if tok.val, err = strconv.ParseFloat(sb.String(), 64); err != nil {
+			err = l.makeError("Invalid float: %s", sb.String())
+		}
 	}
 	return
 }
 
-func (l *Lexer) readNum() (val int, err error) {
-	val = 0
-	found := false
+func (l *lexer) readDigits(sb *strings.Builder) (err error) {
 	for {
 		var r rune
-		r, err = l.readRune()
-		if err != nil {
-			if err == io.EOF && found {
-				err = nil
-			}
+		if r, err = l.peekRune(); err != nil {
 			return
 		}
-		if r < '0' || r > '9' {
-			err = l.rs.UnreadRune()
-			if !found {
-				err = l.unexpectedChar(r)
-			}
+		if !isDigit(r) {
 			return
 		}
-		val = val*10 + (int(r) - '0')
-		found = true
+		l.readRune()
+		sb.WriteRune(r)
+	}
+}
+
+// readString reads a string literal after the opening quote.
+func (l *lexer) readString() (val string, err error) {
+	var (
+		sb strings.Builder
+		r  rune
+	)
+	for {
+		if r, err = l.readRune(); err != nil || r == '\n' {
+			if err == nil {
+				// keep the implicit semicolon
+				l.unreadRune(r)
+			}
+			return "", l.makeError("Unterminated string")
+		}
+		switch r {
+		case '"':
+			return sb.String(), nil
+		case '\\':
+			if r, err = l.readEscape(); err != nil {
+				return
+			}
+		}
+		sb.WriteRune(r)
+	}
+}
+
+// readEscape reads an escape sequence after the backslash.
+func (l *lexer) readEscape() (r rune, err error) {
+	if r, err = l.readRune(); err != nil {
+		return 0, l.makeError("Unterminated string")
+	}
+	switch r {
+	case 'n':
+		return '\n', nil
+	case 't':
+		return '\t', nil
+	case '"', '\\':
+		return r, nil
+	case 'u':
+		return l.readUnicodeEscape()
+	}
+	return 0, l.makeError("Unknown escape sequence: \\%c", r)
+}
+
+// readUnicodeEscape reads the code point of \u{...} escape in hex.
+func (l *lexer) readUnicodeEscape() (r rune, err error) {
+	if r, err = l.readRune(); err != nil || r != '{' {
+		return 0, l.makeError("Malformed unicode escape, { expected")
+	}
+	var sb strings.Builder
+	for {
+		if r, err = l.readRune(); err != nil || r == '"' || r == '\n' {
+			return 0, l.makeError("Malformed unicode escape, } expected")
+		}
+		if r == '}' {
+			break
+		}
+		sb.WriteRune(r)
+	}
+	n, err := strconv.ParseUint(sb.String(), 16, 32)
+	if err != nil || sb.Len() > 6 || !utf8.ValidRune(rune(n)) {
+		return 0, l.makeError("Invalid unicode escape: \\u{%s}", sb.String())
 	}
+	return rune(n), nil
 }
 
-func (l *Lexer) readIdent() (val string, err error) {
+func (l *lexer) readIdent() (val string, err error) {
 	var r rune
 	if r, err = l.readRune(); err != nil {
 		return
@@ -195,17 +401,27 @@ func (l *Lexer) readIdent() (val string, err error) {
 			return
 		}
 		if !(unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_') {
-			err = l.rs.UnreadRune()
+			l.unreadRune(r)
 			return
 		}
 		val += string(r)
 	}
 }
 
-func (l *Lexer) makeError(format string, a ...interface{}) error {
-	return &LexerError{l.line, l.pos, fmt.Sprintf(format, a...)}
+func isDigit(r rune) bool {
+	return r >= '0' && r <= '9'
 }
 
-func (l *Lexer) unexpectedChar(r rune) error {
-	return l.makeError("Unexpected char %c at line %d and pos %d", r, l.line, l.pos)
+// makeError returns an error spanning the token read so far.
+func (l *lexer) makeError(format string, a ...interface{}) error {
+	return &LexerError{Span{l.start, l.position()}, fmt.Sprintf(format, a...)}
+}
+
+// unexpectedChar returns an error spanning the last read char.
+func (l *lexer) unexpectedChar(r rune) error {
+	start := l.position()
+	if n := len(l.hist); n > 0 {
+		start = l.hist[n-1]
+	}
+	return &LexerError{Span{start, l.position()}, fmt.Sprintf("Unexpected char %c", r)}
 }
@@ -0,0 +1,81 @@
+package popi
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestTokenSpan(t *testing.T) {
+	l := newLexer(strings.NewReader("x = 1.5 + foo\n  \"ab\" <= 1..3"))
+	expected := []struct {
+		id   int
+		span Span
+	}{
+		{tokIdent, Span{Pos{1, 1}, Pos{1, 2}}},
+		{tokAssign, Span{Pos{1, 3}, Pos{1, 4}}},
+		{tokFloat, Span{Pos{1, 5}, Pos{1, 8}}},
+		{tokAdd, Span{Pos{1, 9}, Pos{1, 10}}},
+		{tokIdent, Span{Pos{1, 11}, Pos{1, 14}}},
+		{tokSColon, Span{Pos{1, 14}, Pos{2, 1}}},
+		{tokString, Span{Pos{2, 3}, Pos{2, 7}}},
+		{tokLessEqual, Span{Pos{2, 8}, Pos{2, 10}}},
+		{tokInt, Span{Pos{2, 11}, Pos{2, 12}}},
+		{tokRange, Span{Pos{2, 12}, Pos{2, 14}}},
+		{tokInt, Span{Pos{2, 14}, Pos{2, 15}}},
+		{tokEOF, Span{Pos{2, 15}, Pos{2, 15}}},
+	}
+	for _, e := range expected {
+		tok, err := l.ReadToken()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tok.id != e.id || tok.span != e.span {
+			t.Fatal(fmt.Sprintf("%s: expected %v at %v, actual %v at %v",
+				t.Name(), token{id: e.id}, e.span, tok, tok.span))
+		}
+	}
+}
+
+func TestTokenOperators(t *testing.T) {
+	l := newLexer(strings.NewReader("a ** 2 % -b != !c * d"))
+	expected := []int{tokIdent, tokPow, tokInt, tokMod, tokSub, tokIdent,
+		tokNotEqual, tokNot, tokIdent, tokMul, tokIdent, tokEOF}
+	for _, id := range expected {
+		tok, err := l.ReadToken()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tok.id != id {
+			t.Fatalf("%s: expected %v, actual %v", t.Name(), token{id: id}, tok)
+		}
+	}
+}
+
+func TestLexerErrorSpan(t *testing.T) {
+	tests := []struct {
+		src  string
+		span Span
+	}{
+		{"1 +\n  $", Span{Pos{2, 3}, Pos{2, 4}}},
+		{"x = 1e+", Span{Pos{1, 5}, Pos{1, 8}}},
+		{`"a\q"`, Span{Pos{1, 1}, Pos{1, 5}}},
+	}
+	for _, test := range tests {
+		l := newLexer(strings.NewReader(test.src))
+		var err error
+		for err == nil {
+			var tok token
+			if tok, err = l.ReadToken(); tok.id == tokEOF {
+				break
+			}
+		}
+		lerr, ok := err.(*LexerError)
+		if !ok {
+			t.Fatalf("%s: %q: expected lexer error, actual %v", t.Name(), test.src, err)
+		}
+		if lerr.Span() != test.span {
+			t.Fatalf("%s: %q: expected span %v, actual %v", t.Name(), test.src, test.span, lerr.Span())
+		}
+	}
+}
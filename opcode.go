@@ -1,75 +1,364 @@
-package main
+package popi
 
-import "fmt"
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+const (
+	opPushI = 1 + iota
+	opPushF
+	opSwap
+	opDup
+	opOver
+	opRot
+	opDrop
+	opGet
+	opSetI
+	opSetF
+	opAddI
+	opSubI
+	opMulI
+	opDivI
+	opAddF
+	opSubF
+	opMulF
+	opDivF
+	opRet
+	opCall
+	opJmp
+	opJmpF
+	opTrue
+	opFalse
+	opNil
+	opEq
+	opNe
+	opLt
+	opLe
+	opGt
+	opGe
+	opSet
+	opAdd
+	opSub
+	opMul
+	opDiv
+	opPushS
+	opLen
+	opGetGlobal
+	opFunc
+	opField
+	opIndex
+	opCell
+	opGetCell
+	opSetCell
+	opGetUpval
+	opSetUpval
+	opRefUpval
+	opClosure
+	opTailCall
+	opModI
+	opModF
+	opMod
+	opPowI
+	opPowF
+	opPow
+	opNeg
+	opNot
+	opPos
+)
+
+// lastOp is the last opcode.
+const lastOp = opPos
 
+type opCode byte
+
+// Kinds of the operands of the instructions.
 const (
-	OpPushI = 1 + iota
-	OpPushF
-	OpSwap
-	OpDup
-	OpOver
-	OpRot
-	OpDrop
-	OpGet
-	OpSetI
-	OpSetF
-	OpAddI
-	OpSubI
-	OpMulI
-	OpDivI
-	OpAddF
-	OpSubF
-	OpMulF
-	OpDivF
-	OpRet
-	OpCall
+	argConst  = 1 + iota // u16 index of a constant
+	argOffset            // zigzag varint offset of a variable
+	argCount             // uvarint number of arguments, cells, or index of a global or upvalue
+	argAddr              // u32 address of a jump
 )
 
-type OpCode byte
+// opArgs are the operands following the opcodes, opcodes missing here have
+// no operands.
+var opArgs = map[opCode][]int{
+	opPushI:     {argConst},
+	opPushF:     {argConst},
+	opPushS:     {argConst},
+	opFunc:      {argConst},
+	opField:     {argConst},
+	opGet:       {argOffset},
+	opSet:       {argOffset},
+	opGetCell:   {argOffset},
+	opSetCell:   {argOffset},
+	opGetUpval:  {argCount},
+	opSetUpval:  {argCount},
+	opRefUpval:  {argCount},
+	opClosure:   {argConst, argCount},
+	opSetI:      {argOffset, argConst},
+	opSetF:      {argOffset, argConst},
+	opGetGlobal: {argCount},
+	opCall:      {argCount},
+	opTailCall:  {argCount},
+	opJmp:       {argAddr},
+	opJmpF:      {argAddr},
+}
 
-func (op OpCode) String() string {
+// opStack are the numbers of values popped and pushed by the instructions,
+// call and tcall pop the number of arguments given by their operand in
+// addition, and closure the number of cells.
+var opStack = map[opCode]struct{ pop, push int }{
+	opPushI:     {0, 1},
+	opPushF:     {0, 1},
+	opPushS:     {0, 1},
+	opTrue:      {0, 1},
+	opFalse:     {0, 1},
+	opNil:       {0, 1},
+	opFunc:      {0, 1},
+	opGet:       {0, 1},
+	opGetGlobal: {0, 1},
+	opSwap:      {2, 2},
+	opDup:       {1, 2},
+	opOver:      {2, 3},
+	opRot:       {3, 3},
+	opDrop:      {1, 0},
+	opSet:       {1, 0},
+	opSetI:      {0, 0},
+	opSetF:      {0, 0},
+	opAddI:      {2, 1},
+	opSubI:      {2, 1},
+	opMulI:      {2, 1},
+	opDivI:      {2, 1},
+	opAddF:      {2, 1},
+	opSubF:      {2, 1},
+	opMulF:      {2, 1},
+	opDivF:      {2, 1},
+	opAdd:       {2, 1},
+	opSub:       {2, 1},
+	opMul:       {2, 1},
+	opDiv:       {2, 1},
+	opEq:        {2, 1},
+	opNe:        {2, 1},
+	opLt:        {2, 1},
+	opLe:        {2, 1},
+	opGt:        {2, 1},
+	opGe:        {2, 1},
+	opLen:       {1, 1},
+	opField:     {1, 1},
+	opIndex:     {2, 1},
+	opCall:      {1, 1},
+	opTailCall:  {1, 1},
+	opModI:      {2, 1},
+	opModF:      {2, 1},
+	opMod:       {2, 1},
+	opPowI:      {2, 1},
+	opPowF:      {2, 1},
+	opPow:       {2, 1},
+	opNeg:       {1, 1},
+	opNot:       {1, 1},
+	opPos:       {1, 1},
+	opRet:       {1, 0},
+	opJmp:       {0, 0},
+	opJmpF:      {1, 0},
+	opCell:      {1, 1},
+	opGetCell:   {0, 1},
+	opSetCell:   {1, 0},
+	opGetUpval:  {0, 1},
+	opSetUpval:  {1, 0},
+	opRefUpval:  {0, 1},
+	opClosure:   {0, 1},
+}
+
+// instr is a decoded instruction.
+type instr struct {
+	addr int
+	op   opCode
+	args []int
+}
+
+// readInstr reads the instruction at the current address of the code.
+func readInstr(b *byteCode) (in instr, err error) {
+	in.addr = b.Addr()
+	var c byte
+	if c, err = b.ReadByte(); err != nil {
+		return
+	}
+	in.op = opCode(c)
+	if in.op < opPushI || in.op > lastOp {
+		return in, fmt.Errorf("Unknown opcode: %d", c)
+	}
+	for _, arg := range opArgs[in.op] {
+		var (
+			n  int
+			ok bool
+		)
+		switch arg {
+		case argConst:
+			n, ok = b.ReadU16()
+		case argOffset:
+			var x int64
+			x, ok = b.ReadVarint()
+			n = int(x)
+		case argCount:
+			var x uint64
+			if x, ok = b.ReadUvarint(); ok && x > math.MaxInt32 {
+				return in, fmt.Errorf("Invalid operand: %d", x)
+			}
+			n = int(x)
+		case argAddr:
+			n, ok = b.ReadU32()
+		}
+		if !ok {
+			return in, errUnexpectedEnd
+		}
+		in.args = append(in.args, n)
+	}
+	return
+}
+
+func (op opCode) String() string {
 	switch op {
-	case OpPushI:
+	case opPushI:
 		return "pushi"
-	case OpPushF:
+	case opPushF:
 		return "pushf"
-	case OpSwap:
+	case opSwap:
 		return "swap"
-	case OpDup:
+	case opDup:
 		return "dup"
-	case OpOver:
+	case opOver:
 		return "over"
-	case OpRot:
+	case opRot:
 		return "rot"
-	case OpDrop:
+	case opDrop:
 		return "drop"
-	case OpGet:
+	case opGet:
 		return "get"
-	case OpSetI:
+	case opSetI:
 		return "seti"
-	case OpSetF:
+	case opSetF:
 		return "setf"
-	case OpAddI:
+	case opAddI:
 		return "addi"
-	case OpSubI:
+	case opSubI:
 		return "subi"
-	case OpMulI:
+	case opMulI:
 		return "muli"
-	case OpDivI:
+	case opDivI:
 		return "divi"
-	case OpAddF:
+	case opAddF:
 		return "addf"
-	case OpSubF:
+	case opSubF:
 		return "subf"
-	case OpMulF:
+	case opMulF:
 		return "mulf"
-	case OpDivF:
+	case opDivF:
 		return "divf"
-	case OpRet:
+	case opRet:
 		return "ret"
-	case OpCall:
+	case opCall:
 		return "call"
+	case opJmp:
+		return "jmp"
+	case opJmpF:
+		return "jmpf"
+	case opTrue:
+		return "true"
+	case opFalse:
+		return "false"
+	case opNil:
+		return "nil"
+	case opEq:
+		return "eq"
+	case opNe:
+		return "ne"
+	case opLt:
+		return "lt"
+	case opLe:
+		return "le"
+	case opGt:
+		return "gt"
+	case opGe:
+		return "ge"
+	case opSet:
+		return "set"
+	case opAdd:
+		return "add"
+	case opSub:
+		return "sub"
+	case opMul:
+		return "mul"
+	case opDiv:
+		return "div"
+	case opPushS:
+		return "pushs"
+	case opLen:
+		return "len"
+	case opGetGlobal:
+		return "getg"
+	case opFunc:
+		return "func"
+	case opField:
+		return "field"
+	case opIndex:
+		return "index"
+	case opCell:
+		return "cell"
+	case opGetCell:
+		return "getc"
+	case opSetCell:
+		return "setc"
+	case opGetUpval:
+		return "getu"
+	case opSetUpval:
+		return "setu"
+	case opRefUpval:
+		return "refu"
+	case opClosure:
+		return "closure"
+	case opTailCall:
+		return "tcall"
+	case opModI:
+		return "modi"
+	case opModF:
+		return "modf"
+	case opMod:
+		return "mod"
+	case opPowI:
+		return "powi"
+	case opPowF:
+		return "powf"
+	case opPow:
+		return "pow"
+	case opNeg:
+		return "neg"
+	case opNot:
+		return "not"
+	case opPos:
+		return "pos"
 	default:
 		return fmt.Sprintf("%d", op)
 	}
 }
+
+// writeInstr writes the encoded instruction.
+func writeInstr(buf *bytes.Buffer, in instr) {
+	buf.WriteByte(byte(in.op))
+	for k, arg := range in.args {
+		var b [binary.MaxVarintLen64]byte
+		switch opArgs[in.op][k] {
+		case argConst:
+			buf.Write([]byte{byte(arg), byte(arg >> 8)})
+		case argOffset:
+			buf.Write(b[:binary.PutVarint(b[:], int64(arg))])
+		case argCount:
+			buf.Write(b[:binary.PutUvarint(b[:], uint64(arg))])
+		case argAddr:
+			binary.LittleEndian.PutUint32(b[:], uint32(arg))
+			buf.Write(b[:4])
+		}
+	}
+}
@@ -1,376 +1,755 @@
-package main
+package popi
 
 import (
-	"bytes"
-	"encoding/binary"
 	"fmt"
 	"io"
+	"sort"
+	"strings"
 )
 
+// ErrorList is a list of errors found in a single run.
+type ErrorList []error
+
+func (list ErrorList) Error() string {
+	msgs := make([]string, len(list))
+	for i, err := range list {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+func (list ErrorList) Unwrap() []error {
+	return list
+}
+
+// sort orders the errors with a position by their start.
+func (list ErrorList) sort() {
+	sort.SliceStable(list, func(i, j int) bool {
+		x, ok := list[i].(spanError)
+		if !ok {
+			return false
+		}
+		y, ok := list[j].(spanError)
+		if !ok {
+			return true
+		}
+		a, b := x.Span().Start, y.Span().Start
+		return a.Line < b.Line || a.Line == b.Line && a.Col < b.Col
+	})
+}
+
 type ParserError struct {
-	line int
-	pos  int
+	span Span
 	msg  string
+	hint string
 }
 
 func (err *ParserError) Error() string {
-	return fmt.Sprintf("%s at line %d and position %d", err.msg, err.line, err.pos)
+	return fmt.Sprintf("%s at line %d and position %d", err.msg, err.span.Start.Line, err.span.Start.Col)
 }
 
 func (err *ParserError) Line() int {
-	return err.line
+	return err.span.Start.Line
 }
 
 func (err *ParserError) Pos() int {
-	return err.pos
+	return err.span.Start.Col
+}
+
+func (err *ParserError) Span() Span {
+	return err.span
 }
 
 func (err *ParserError) Msg() string {
 	return err.msg
 }
 
-type Parser struct {
-	lex   *Lexer
-	code  *bytes.Buffer
-	tok   Token
-	line  int
-	pos   int
-	scope *Scope
+// Hint returns a suggestion how to fix the error, if there is any.
+func (err *ParserError) Hint() string {
+	return err.hint
 }
 
-type Scope struct {
-	item      *Item
-	stackSize int
-	next      *Scope
+type parser struct {
+	lex  *lexer
+	tok  token
+	errs ErrorList
 }
 
-const (
-	ItemVar = iota
-	ItemParam
-)
-
-type ItemTyp byte
+func newParser(rs io.RuneScanner) *parser {
+	return &parser{newLexer(rs), token{}, nil}
+}
 
-type Item struct {
-	typ   ItemTyp
-	ident string
-	val   int
-	next  *Item
+// Parse parses the source and generates its code. Syntax errors do not
+// stop the parsing, all of them are returned in ErrorList together with
+// the errors found by the code generator.
+func (p *parser) Parse() (prog *Program, err error) {
+	return p.parse(newCodeGen())
 }
 
-func NewParser(rs io.RuneScanner) *Parser {
-	code := &bytes.Buffer{}
-	return &Parser{NewLexer(rs), code, Token{}, 1, 1, &Scope{}}
+func (p *parser) parse(g *codeGen) (prog *Program, err error) {
+	var ast *block
+	if ast, err = p.ParseAST(); err != nil {
+		if _, ok := err.(ErrorList); !ok {
+			return
+		}
+	}
+	prog, genErr := g.Generate(ast)
+	if genErr == nil && err == nil {
+		return
+	}
+	errs, _ := err.(ErrorList)
+	if list, ok := genErr.(ErrorList); ok {
+		errs = append(errs, list...)
+	} else if genErr != nil {
+		errs = append(errs, genErr)
+	}
+	errs.sort()
+	return nil, errs
 }
 
-func (p *Parser) Parse() (buf []byte, err error) {
-	err = p.readExprList()
-	if err == nil {
-		buf = p.code.Bytes()
+// ParseAST parses the source into the syntax tree. On syntax errors the
+// tree is returned too, with the erroneous statements replaced by
+// badExpr, and the errors in ErrorList.
+func (p *parser) ParseAST() (prog *block, err error) {
+	prog = &block{}
+	for {
+		var list []node
+		if list, err = p.readExprList(); err != nil {
+			return
+		}
+		prog.List = append(prog.List, list...)
+		if err = p.readToken(); err != nil {
+			if err = p.recover(err); err != nil {
+				return
+			}
+			continue
+		}
+		if p.tok.id == tokEOF {
+			break
+		}
+		// stray closing brace, unless it is reported as the start of a
+		// statement already
+		if !p.reported(p.tok.span) {
+			p.errs = append(p.errs, p.unexpectedToken("EOF"))
+		}
+		// no statement is expected if the brace ends the source
+		if err = p.skipSColons(); err != nil {
+			return
+		}
+		if err = p.readToken(); err != nil {
+			if err = p.recover(err); err != nil {
+				return
+			}
+			continue
+		}
+		if p.tok.id == tokEOF {
+			break
+		}
+		if err = p.unreadToken(); err != nil {
+			return
+		}
+	}
+	if len(prog.List) > 0 {
+		prog.span = spanOf(prog.List[0], prog.List[len(prog.List)-1])
+	}
+	if len(p.errs) > 0 {
+		err = p.errs
 	}
 	return
 }
 
-func (p *Parser) readToken() (err error) {
-	p.line, p.pos = p.lex.line, p.lex.pos
+// reported returns whether the last recorded error is at the span.
+func (p *parser) reported(span Span) bool {
+	if n := len(p.errs); n > 0 {
+		if err, ok := p.errs[n-1].(spanError); ok {
+			return err.Span() == span
+		}
+	}
+	return false
+}
+
+func (p *parser) readToken() (err error) {
 	p.tok, err = p.lex.ReadToken()
 	return err
 }
 
-func (p *Parser) unreadToken() (err error) {
+func (p *parser) unreadToken() (err error) {
 	return p.lex.UnreadToken(p.tok)
 }
 
-func (p *Parser) readExprList() (err error) {
-	if err = p.readExpr(); err != nil {
+func (p *parser) readExprList() (list []node, err error) {
+	var n node
+	if err = p.skipSColons(); err != nil {
 		return
 	}
+	if n, err = p.readStmt(); err != nil {
+		return
+	}
+	list = append(list, n)
 	for {
 		if err = p.readToken(); err != nil {
+			if err = p.recover(err); err != nil {
+				return
+			}
+			continue
+		}
+		if p.tok.id == tokEOF || p.tok.id == tokRBrace {
+			err = p.unreadToken()
 			return
 		}
-		if p.tok.id == TokEOF {
+		if p.tok.id != tokSColon {
+			if err = p.recover(p.unexpectedToken(";")); err != nil {
+				return
+			}
+			continue
+		}
+		if err = p.skipSColons(); err != nil {
 			return
 		}
-		if p.tok.id != TokSColon {
-			return p.unexpectedToken(";")
+		if err = p.readToken(); err != nil {
+			return
 		}
-		for {
-			if err = p.readToken(); err != nil {
-				return
+		if p.tok.id == tokEOF || p.tok.id == tokRBrace {
+			err = p.unreadToken()
+			return
+		}
+		if err = p.unreadToken(); err != nil {
+			return
+		}
+		if n, err = p.readStmt(); err != nil {
+			return
+		}
+		list = append(list, n)
+	}
+}
+
+// readStmt reads a statement of an expression list, i.e. a declaration or
+// an expression. A syntax error is recorded and the rest of the statement
+// skipped, so the parsing can go on. A declaration failing after its name
+// is kept with badExpr as its value, so the uses of the name are not
+// reported as unknown variables.
+func (p *parser) readStmt() (n node, err error) {
+	start := p.lex.start
+	if n, err = p.readDeclOrExpr(); err != nil {
+		decl, _ := n.(*assign)
+		if err = p.recover(err); err == nil {
+			bad := &badExpr{nodeSpan{Span{start, p.lex.start}}}
+			n = bad
+			if decl != nil && decl.Tok != 0 {
+				decl.Val, decl.span = bad, bad.span
+				n = decl
 			}
-			if p.tok.id != TokSColon {
-				if err = p.unreadToken(); err != nil {
-					return
-				}
-				break
+		}
+	}
+	return
+}
+
+// readDeclOrExpr reads a declaration, which is a statement of its own, or
+// an expression, which cannot contain declarations.
+func (p *parser) readDeclOrExpr() (n node, err error) {
+	if err = p.readToken(); err != nil {
+		return
+	}
+	switch p.tok.id {
+	case tokLet, tokVar, tokConst:
+		return p.readDecl()
+	}
+	if err = p.unreadToken(); err != nil {
+		return
+	}
+	return p.readExpr()
+}
+
+// recover records the syntax error and skips the tokens up to the end of
+// the statement, i.e. the next semicolon, new line or closing brace of the
+// enclosing block, which is left to be read. Other errors are returned.
+func (p *parser) recover(err error) error {
+	switch err.(type) {
+	case *LexerError:
+		p.errs = append(p.errs, err)
+		return p.synchronize(0)
+	case *ParserError:
+		p.errs = append(p.errs, err)
+		depth := 0
+		if p.lex.tok.id == tokNone {
+			// the offending token was consumed
+			switch p.tok.id {
+			case tokSColon, tokRBrace, tokEOF:
+				return p.unreadToken()
+			case tokLBrace:
+				depth++
 			}
 		}
-		if err = p.readToken(); err == nil {
-			if err = p.unreadToken(); err != nil {
+		return p.synchronize(depth)
+	}
+	return err
+}
+
+// synchronize skips tokens up to the end of the statement, depth is the
+// number of braces already opened within the statement.
+func (p *parser) synchronize(depth int) (err error) {
+	for {
+		if err = p.readToken(); err != nil {
+			if _, ok := err.(*LexerError); !ok {
 				return
 			}
-			p.writeOp(OpDrop)
+			p.errs = append(p.errs, err)
+			continue
 		}
-		if err = p.readExpr(); err != nil {
+		switch p.tok.id {
+		case tokEOF:
+			return p.unreadToken()
+		case tokSColon:
+			if depth == 0 {
+				return p.unreadToken()
+			}
+		case tokLBrace:
+			depth++
+		case tokRBrace:
+			if depth == 0 {
+				return p.unreadToken()
+			}
+			depth--
+		}
+	}
+}
+
+func (p *parser) skipSColons() (err error) {
+	for {
+		if err = p.readToken(); err != nil {
 			return
 		}
+		if p.tok.id != tokSColon {
+			return p.unreadToken()
+		}
 	}
 }
 
-func (p *Parser) readExpr() (err error) {
-	return p.readTerm()
+// binaryOp is the precedence of a binary operator, the operators of higher
+// precedence bind tighter, and its associativity.
+type binaryOp struct {
+	prec  int
+	right bool
+}
+
+const (
+	precCompare = iota + 1
+	precSum
+	precProduct
+	precUnary
+	precPower
+)
+
+// binaryOps are the binary operators, all of them left associative but
+// the power, so 2 ** 3 ** 2 is 2 ** 9.
+var binaryOps = map[int]binaryOp{
+	tokEqual:        {precCompare, false},
+	tokNotEqual:     {precCompare, false},
+	tokLess:         {precCompare, false},
+	tokLessEqual:    {precCompare, false},
+	tokGreater:      {precCompare, false},
+	tokGreaterEqual: {precCompare, false},
+	tokAdd:          {precSum, false},
+	tokSub:          {precSum, false},
+	tokMul:          {precProduct, false},
+	tokDiv:          {precProduct, false},
+	tokMod:          {precProduct, false},
+	tokPow:          {precPower, true},
+}
+
+func (p *parser) readExpr() (n node, err error) {
+	return p.readBinary(precCompare)
 }
 
-func (p *Parser) readTerm() (err error) {
-	if err = p.readFactor(); err != nil {
+// readBinary reads the operations of the operators of at least the given
+// precedence by precedence climbing, the operand of the operation is read
+// with the higher precedence, or the same one for right associativity.
+func (p *parser) readBinary(prec int) (n node, err error) {
+	if n, err = p.readUnary(); err != nil {
 		return
 	}
 	for {
 		if err = p.readToken(); err != nil {
 			return
 		}
-		var op OpCode
-		switch p.tok.id {
-		case TokAdd:
-			op = OpAddI
-		case TokSub:
-			op = OpSubI
-		default:
-			return p.unreadToken()
+		op := p.tok.id
+		bin, ok := binaryOps[op]
+		if !ok || bin.prec < prec {
+			err = p.unreadToken()
+			return
 		}
-		if err = p.readFactor(); err != nil {
+		next := bin.prec + 1
+		if bin.right {
+			next = bin.prec
+		}
+		var y node
+		if y, err = p.readBinary(next); err != nil {
 			return
 		}
-		p.writeOp(op)
+		n = &binaryExpr{nodeSpan{spanOf(n, y)}, op, n, y}
 	}
 }
 
-func (p *Parser) readFactor() (err error) {
-	if err = p.readVal(); err != nil {
+// readUnary reads a value with the unary operators, which bind tighter
+// than the binary ones but the power, so -2 ** 2 is -(2 ** 2).
+func (p *parser) readUnary() (n node, err error) {
+	if err = p.readToken(); err != nil {
+		return
+	}
+	switch tok := p.tok; tok.id {
+	case tokSub, tokAdd, tokNot:
+		var x node
+		if x, err = p.readBinary(precUnary); err != nil {
+			return
+		}
+		return &unaryExpr{nodeSpan{Span{tok.span.Start, x.Span().End}}, tok.id, x}, nil
+	}
+	if err = p.unreadToken(); err != nil {
+		return
+	}
+	return p.readVal()
+}
+
+func (p *parser) readVal() (n node, err error) {
+	if err = p.readToken(); err != nil {
+		return
+	}
+	span := p.tok.span
+	switch p.tok.id {
+	case tokInt:
+		n = &intLit{nodeSpan{span}, p.tok.val.(int)}
+	case tokFloat:
+		n = &floatLit{nodeSpan{span}, p.tok.val.(float64)}
+	case tokString:
+		n = &stringLit{nodeSpan{span}, p.tok.val.(string)}
+	case tokTrue:
+		n = &boolLit{nodeSpan{span}, true}
+	case tokFalse:
+		n = &boolLit{nodeSpan{span}, false}
+	case tokLParen:
+		if n, err = p.readExpr(); err != nil {
+			return
+		}
+		if err = p.expect(tokRParen, ")"); err != nil {
+			return
+		}
+	case tokFn:
+		if n, err = p.readFunc(); err != nil {
+			return
+		}
+	case tokIf:
+		if n, err = p.readIf(); err != nil {
+			return
+		}
+	case tokWhile:
+		if n, err = p.readWhile(); err != nil {
+			return
+		}
+	case tokFor:
+		if n, err = p.readFor(); err != nil {
+			return
+		}
+	case tokBreak, tokContinue:
+		n = &branchExpr{nodeSpan{span}, p.tok.id}
+	case tokReturn:
+		if n, err = p.readReturn(); err != nil {
+			return
+		}
+	case tokLet, tokVar, tokConst:
+		err = &ParserError{span, fmt.Sprintf("Unexpected declaration: %s, value expected", p.tok),
+			"declare the variable in a statement before the expression"}
+		return
+	case tokIdent:
+		ident := &identifier{nodeSpan{span}, p.tok.val.(string)}
+		if err = p.readToken(); err != nil {
+			return
+		}
+		if p.tok.id == tokAssign {
+			// variable assignment
+			var val node
+			if val, err = p.readExpr(); err != nil {
+				return
+			}
+			n = &assign{nodeSpan{spanOf(ident, val)}, 0, ident, val}
+			return
+		}
+		if err = p.unreadToken(); err != nil {
+			return
+		}
+		n = ident
+	default:
+		err = p.unexpectedToken("value")
 		return
 	}
 	for {
 		if err = p.readToken(); err != nil {
 			return
 		}
-		var op OpCode
 		switch p.tok.id {
-		case TokMul:
-			op = OpMulI
-		case TokDiv:
-			op = OpDivI
+		case tokLParen:
+			n, err = p.readCall(n)
+		case tokDot:
+			n, err = p.readSelector(n)
+		case tokLBracket:
+			n, err = p.readIndex(n)
 		default:
-			return p.unreadToken()
+			err = p.unreadToken()
+			return
 		}
-		if err = p.readVal(); err != nil {
+		if err != nil {
 			return
 		}
-		p.writeOp(op)
 	}
 }
 
-func (p *Parser) readVal() (err error) {
+// readSelector reads the name of a field or method of x after the dot.
+func (p *parser) readSelector(x node) (n node, err error) {
+	if err = p.expect(tokIdent, "ident"); err != nil {
+		return
+	}
+	sel := &identifier{nodeSpan{p.tok.span}, p.tok.val.(string)}
+	return &selectorExpr{nodeSpan{spanOf(x, sel)}, x, sel}, nil
+}
+
+// readIndex reads the index of x in brackets.
+func (p *parser) readIndex(x node) (n node, err error) {
+	var index node
+	if index, err = p.readExpr(); err != nil {
+		return
+	}
+	if err = p.expect(tokRBracket, "]"); err != nil {
+		return
+	}
+	return &indexExpr{nodeSpan{Span{x.Span().Start, p.tok.span.End}}, x, index}, nil
+}
+
+// readCall reads the argument list of a call of fn.
+func (p *parser) readCall(fn node) (n node, err error) {
+	call := &callExpr{Fn: fn}
 	if err = p.readToken(); err != nil {
 		return
 	}
-	switch p.tok.id {
-	case TokInt:
-		p.writeOp(OpPushI)
-		p.writeInt(p.tok.val.(int))
-	case TokFn:
-		return p.readFunc()
-	case TokIdent:
-		ident := p.tok.val.(string)
-		if err = p.readToken(); err != nil {
+	if p.tok.id != tokRParen {
+		if err = p.unreadToken(); err != nil {
 			return
 		}
-		if p.tok.id == TokAssign {
-			// variable assignment
-			if err = p.readExpr(); err != nil {
+		for {
+			var arg node
+			if arg, err = p.readExpr(); err != nil {
 				return
 			}
-			p.pushItem(p.newVar(ident))
-			p.writeOp(OpDup)
-		} else {
-			if err = p.unreadToken(); err != nil {
+			call.Args = append(call.Args, arg)
+			if err = p.readToken(); err != nil {
 				return
 			}
-			// variable evaluation
-			scope := p.scope
-			for scope != nil {
-				item := scope.item
-				for item != nil {
-					if item.ident == ident {
-						p.writeOp(OpGet)
-						p.writeInt(item.val)
-						return
-					}
-					item = item.next
-				}
-				scope = scope.next
+			if p.tok.id == tokRParen {
+				break
+			}
+			if p.tok.id != tokComma {
+				err = p.unexpectedToken(")")
+				return
 			}
-			return fmt.Errorf("Unknown variable: %s", ident)
 		}
-	default:
-		return p.unexpectedToken("value")
 	}
-	return
+	call.span = Span{fn.Span().Start, p.tok.span.End}
+	return call, nil
 }
 
-func (p *Parser) readFunc() (err error) {
-	p.writeOp(OpPushI)
-	p.writeInt(p.code.Len() - 1) // function address
-	p.pushScope(&Scope{})
-	defer p.popScope()
-	if err = p.readToken(); err != nil {
+// readFunc reads a function definition after the fn keyword.
+func (p *parser) readFunc() (n node, err error) {
+	fn := &funcLit{}
+	start := p.tok.span.Start
+	if err = p.expect(tokLParen, "("); err != nil {
 		return
 	}
-	if p.tok.id != TokLParen {
-		return p.unexpectedToken("(")
-	}
-	if err = p.readFuncParams(); err != nil {
+	if fn.Params, err = p.readFuncParams(); err != nil {
 		return
 	}
-	if err = p.readToken(); err != nil {
+	if err = p.expect(tokRParen, ")"); err != nil {
 		return
 	}
-	if p.tok.id != TokRParen {
-		return p.unexpectedToken(")")
-	}
-	if err = p.readFuncBody(); err != nil {
+	if fn.Body, err = p.readBlock(); err != nil {
 		return
 	}
-	p.writeOp(OpRet)
-	return
+	fn.span = Span{start, fn.Body.span.End}
+	return fn, nil
 }
 
-func (p *Parser) readFuncParams() (err error) {
+func (p *parser) readFuncParams() (params []*identifier, err error) {
 	if err = p.readToken(); err != nil {
 		return
 	}
-	if p.tok.id != TokIdent {
-		return p.unexpectedToken("ident")
+	if p.tok.id == tokRParen {
+		err = p.unreadToken()
+		return
 	}
-	ident := p.tok.val.(string)
-	p.pushItem(p.newParam(ident, 0))
-	for pos := 1; ; pos++ {
+	for {
+		if p.tok.id != tokIdent {
+			err = p.unexpectedToken("ident")
+			return
+		}
+		params = append(params, &identifier{nodeSpan{p.tok.span}, p.tok.val.(string)})
 		if err = p.readToken(); err != nil {
 			return
 		}
-		if p.tok.id != TokComma {
+		if p.tok.id != tokComma {
 			err = p.unreadToken()
 			return
 		}
 		if err = p.readToken(); err != nil {
 			return
 		}
-		if p.tok.id != TokIdent {
-			err = p.unexpectedToken("ident")
-			return
-		}
-		ident = p.tok.val.(string)
-		p.pushItem(p.newParam(ident, pos))
 	}
 }
 
-func (p *Parser) readFuncBody() (err error) {
-	if err = p.readToken(); err != nil {
+// readIf reads an if expression after the if keyword.
+func (p *parser) readIf() (n node, err error) {
+	expr := &ifExpr{}
+	start := p.tok.span.Start
+	if expr.Cond, err = p.readExpr(); err != nil {
 		return
 	}
-	if p.tok.id != TokLBrace {
-		err = p.unexpectedToken("{")
+	if expr.Then, err = p.readBlock(); err != nil {
 		return
 	}
-	if err = p.readExprList(); err != nil {
+	expr.span = Span{start, expr.Then.span.End}
+	if err = p.readToken(); err != nil {
 		return
 	}
-	if p.tok.id != TokRBrace {
-		err = p.unexpectedToken("}")
+	if p.tok.id != tokElse {
+		err = p.unreadToken()
+		return expr, err
+	}
+	if err = p.readToken(); err != nil {
 		return
 	}
-	return
+	if p.tok.id == tokIf {
+		expr.Else, err = p.readIf()
+	} else if err = p.unreadToken(); err == nil {
+		expr.Else, err = p.readBlock()
+	}
+	if err != nil {
+		return
+	}
+	expr.span.End = expr.Else.Span().End
+	return expr, nil
 }
 
-func (p *Parser) unexpectedToken(expected string) (err error) {
-	return &ParserError{p.lex.line, p.lex.pos,
-		fmt.Sprintf("Unexpected token: %s, %s expected", p.tok, expected)}
+// readWhile reads a while loop after the while keyword.
+func (p *parser) readWhile() (n node, err error) {
+	loop := &whileExpr{}
+	start := p.tok.span.Start
+	if loop.Cond, err = p.readExpr(); err != nil {
+		return
+	}
+	if loop.Body, err = p.readBlock(); err != nil {
+		return
+	}
+	loop.span = Span{start, loop.Body.span.End}
+	return loop, nil
 }
 
-func (p *Parser) pushItem(item *Item) {
-	item.next = p.scope.item
-	p.scope.item = item
+// readFor reads a loop over a range after the for keyword.
+func (p *parser) readFor() (n node, err error) {
+	loop := &forExpr{}
+	start := p.tok.span.Start
+	if err = p.expect(tokIdent, "ident"); err != nil {
+		return
+	}
+	loop.Var = &identifier{nodeSpan{p.tok.span}, p.tok.val.(string)}
+	if err = p.expect(tokIn, "in"); err != nil {
+		return
+	}
+	if loop.From, err = p.readExpr(); err != nil {
+		return
+	}
+	if err = p.expect(tokRange, ".."); err != nil {
+		return
+	}
+	if loop.To, err = p.readExpr(); err != nil {
+		return
+	}
+	if loop.Body, err = p.readBlock(); err != nil {
+		return
+	}
+	loop.span = Span{start, loop.Body.span.End}
+	return loop, nil
 }
 
-func (p *Parser) pushScope(scope *Scope) {
-	scope.next = p.scope
-	p.scope = scope
+// readDecl reads a declaration of a variable after the let, var or const
+// keyword, the value is required. The declaration is returned with the
+// error too once its name is read.
+func (p *parser) readDecl() (n node, err error) {
+	tok := p.tok
+	if err = p.expect(tokIdent, "ident"); err != nil {
+		return
+	}
+	ident := &identifier{nodeSpan{p.tok.span}, p.tok.val.(string)}
+	decl := &assign{nodeSpan{Span{tok.span.Start, ident.span.End}}, tok.id, ident, nil}
+	if err = p.expect(tokAssign, "="); err != nil {
+		return decl, err
+	}
+	if decl.Val, err = p.readExpr(); err != nil {
+		return decl, err
+	}
+	decl.span.End = decl.Val.Span().End
+	return decl, nil
 }
 
-func (p *Parser) popScope() (scope *Scope) {
-	scope = p.scope
-	p.scope = scope.next
-	scope.next = nil
-	return
+// readReturn reads the value returned after the return keyword, which is
+// omitted at the end of a statement.
+func (p *parser) readReturn() (n node, err error) {
+	ret := &returnExpr{nodeSpan{p.tok.span}, nil}
+	if err = p.readToken(); err != nil {
+		return
+	}
+	switch p.tok.id {
+	case tokSColon, tokRBrace, tokEOF:
+		err = p.unreadToken()
+		return ret, err
+	}
+	if err = p.unreadToken(); err != nil {
+		return
+	}
+	if ret.Val, err = p.readExpr(); err != nil {
+		return
+	}
+	ret.span.End = ret.Val.Span().End
+	return ret, nil
 }
 
-func (p *Parser) writeOp(op OpCode) (err error) {
-	if err = p.code.WriteByte(byte(op)); err != nil {
-		return
-	}
-	switch op {
-	case OpPushI:
-		p.scope.stackSize++
-	case OpPushF:
-		p.scope.stackSize++
-	case OpSwap:
-	case OpDup:
-		p.scope.stackSize++
-	case OpOver:
-		p.scope.stackSize++
-	case OpRot:
-	case OpDrop:
-		p.scope.stackSize--
-	case OpGet:
-		p.scope.stackSize++
-	case OpSetI:
-	case OpSetF:
-	case OpAddI:
-		p.scope.stackSize--
-	case OpSubI:
-		p.scope.stackSize--
-	case OpMulI:
-		p.scope.stackSize--
-	case OpDivI:
-		p.scope.stackSize--
-	case OpAddF:
-		p.scope.stackSize--
-	case OpSubF:
-		p.scope.stackSize--
-	case OpMulF:
-		p.scope.stackSize--
-	case OpDivF:
-		p.scope.stackSize--
-	case OpRet:
-	case OpCall:
-	default:
-		panic(fmt.Errorf("Unexpected opcode: %s", op))
+// readBlock reads an expression list in braces.
+func (p *parser) readBlock() (b *block, err error) {
+	if err = p.expect(tokLBrace, "{"); err != nil {
+		return
+	}
+	b = &block{}
+	start := p.tok.span.Start
+	if b.List, err = p.readExprList(); err != nil {
+		return
+	}
+	if err = p.expect(tokRBrace, "}"); err != nil {
+		return
 	}
+	b.span = Span{start, p.tok.span.End}
 	return
 }
 
-func (p *Parser) writeInt(n int) error {
-	return binary.Write(p.code, binary.LittleEndian, int64(n))
-}
-
-func (p *Parser) writeFloat(n float64) error {
-	return binary.Write(p.code, binary.LittleEndian, n)
+// expect reads the next token, which must be of the given id.
+func (p *parser) expect(id int, expected string) (err error) {
+	if err = p.readToken(); err != nil {
+		return
+	}
+	if p.tok.id != id {
+		return p.unexpectedToken(expected)
+	}
+	return
 }
 
-func (p *Parser) newVar(ident string) *Item {
-	return &Item{typ: ItemVar, ident: ident, val: p.scope.stackSize - 1}
+func (p *parser) unexpectedToken(expected string) (err error) {
+	return p.makeError(p.tok.span, "Unexpected token: %s, %s expected", p.tok, expected)
 }
 
-func (p *Parser) newParam(ident string, pos int) *Item {
-	return &Item{typ: ItemParam, ident: ident, val: pos}
+func (p *parser) makeError(span Span, format string, a ...interface{}) error {
+	return &ParserError{span, fmt.Sprintf(format, a...), ""}
 }
@@ -0,0 +1,277 @@
+package popi
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestParserErrorSpan(t *testing.T) {
+	tests := []struct {
+		src  string
+		msg  string
+		span Span
+	}{
+		{"let x = 1\ny + x", "Unknown variable: y", Span{Pos{2, 1}, Pos{2, 2}}},
+		{"f = fn(a, 1) { a }", "Unexpected token: 1, ident expected", Span{Pos{1, 11}, Pos{1, 12}}},
+		{"1 +  * 2", "Unexpected token: *, value expected", Span{Pos{1, 6}, Pos{1, 7}}},
+		{"if true { 1 ", "Unexpected token: EOF, } expected", Span{Pos{1, 13}, Pos{1, 13}}},
+		{"(1 + 2", "Unexpected token: EOF, ) expected", Span{Pos{1, 7}, Pos{1, 7}}},
+		{"2 ** * 3", "Unexpected token: *, value expected", Span{Pos{1, 6}, Pos{1, 7}}},
+	}
+	for _, test := range tests {
+		_, err := newParser(strings.NewReader(test.src)).Parse()
+		var perr *ParserError
+		if !errors.As(err, &perr) {
+			t.Fatalf("%s: %q: expected parser error, actual %v", t.Name(), test.src, err)
+		}
+		if perr.Msg() != test.msg || perr.Span() != test.span {
+			t.Fatalf("%s: %q: unexpected error %q at %v", t.Name(), test.src, perr.Msg(), perr.Span())
+		}
+	}
+}
+
+func TestParserRecovery(t *testing.T) {
+	src := `x = 1 +
+y = * 2
+let f = fn(a) {
+	b = a $ 1
+	let c = a 2
+	a + c
+}
+let z = foo
+if f == { 1 } else { 2 }; let w = 3
+}
+let total = 1; totl`
+	_, err := newParser(strings.NewReader(src)).Parse()
+	list, ok := err.(ErrorList)
+	if !ok {
+		t.Fatalf("%s: expected error list, actual %v", t.Name(), err)
+	}
+	expected := []string{
+		"Unexpected token: ;, value expected at line 1 and position 8",
+		"Unexpected token: *, value expected at line 2 and position 5",
+		"Unexpected char $ at line 4 and position 8",
+		"Unexpected token: 2, ; expected at line 5 and position 12",
+		"Unknown variable: foo at line 8 and position 9",
+		"Unexpected token: {, value expected at line 9 and position 9",
+		"Unexpected token: }, EOF expected at line 10 and position 1",
+		"Unknown variable: totl at line 11 and position 16",
+	}
+	if len(list) != len(expected) {
+		t.Fatalf("%s: expected %d errors, actual %d:\n%s", t.Name(), len(expected), len(list), list)
+	}
+	for i, err := range list {
+		checkEqualString(t, expected[i], err.Error())
+	}
+}
+
+func TestParserRecoveryBraces(t *testing.T) {
+	tests := []struct {
+		src  string
+		errs []string
+	}{
+		{"}", []string{"Unexpected token: }, value expected at line 1 and position 1"}},
+		{"1; }", []string{"Unexpected token: }, EOF expected at line 1 and position 4"}},
+		{"1 }\n2", []string{"Unexpected token: }, EOF expected at line 1 and position 3"}},
+		{"}}}", []string{
+			"Unexpected token: }, value expected at line 1 and position 1",
+			"Unexpected token: }, value expected at line 1 and position 2",
+			"Unexpected token: }, value expected at line 1 and position 3",
+		}},
+		{"1 }; }\n", []string{
+			"Unexpected token: }, EOF expected at line 1 and position 3",
+			"Unexpected token: }, value expected at line 1 and position 6",
+		}},
+	}
+	for _, test := range tests {
+		_, err := newParser(strings.NewReader(test.src)).ParseAST()
+		list, ok := err.(ErrorList)
+		if !ok {
+			t.Fatalf("%s: %q: expected error list, actual %v", t.Name(), test.src, err)
+		}
+		if len(list) != len(test.errs) {
+			t.Fatalf("%s: %q: expected %d errors, actual %d:\n%s", t.Name(), test.src, len(test.errs), len(list), list)
+		}
+		for i, err := range list {
+			checkEqualString(t, test.errs[i], err.Error())
+		}
+	}
+}
+
+func TestParserRecoveryDecl(t *testing.T) {
+	tests := []struct {
+		src  string
+		errs []string
+	}{
+		// the names of failed declarations are declared still
+		{"let z = (3\nz", []string{"Unexpected token: ;, ) expected at line 1 and position 11"}},
+		{"let z = 1 +\nz + 1", []string{"Unexpected token: ;, value expected at line 1 and position 12"}},
+		{"let x 1\nx * 2", []string{"Unexpected token: 1, = expected at line 1 and position 7"}},
+		{"const k = *\nk = 1", []string{
+			"Unexpected token: *, value expected at line 1 and position 11",
+			"Cannot assign to constant: k at line 2 and position 1",
+		}},
+		{"let = 1\ny", []string{
+			"Unexpected token: =, ident expected at line 1 and position 5",
+			"Unknown variable: y at line 2 and position 1",
+		}},
+	}
+	for _, test := range tests {
+		_, err := newParser(strings.NewReader(test.src)).Parse()
+		list, ok := err.(ErrorList)
+		if !ok {
+			t.Fatalf("%s: %q: expected error list, actual %v", t.Name(), test.src, err)
+		}
+		if len(list) != len(test.errs) {
+			t.Fatalf("%s: %q: expected %d errors, actual %d:\n%s", t.Name(), test.src, len(test.errs), len(list), list)
+		}
+		for i, err := range list {
+			checkEqualString(t, test.errs[i], err.Error())
+		}
+	}
+}
+
+func TestParseAST(t *testing.T) {
+	prog, err := newParser(strings.NewReader("let f = fn(a) { a * 2 }\nf(1 + 2)")).ParseAST()
+	if err != nil {
+		t.Fatalf("%s: %v", t.Name(), err)
+	}
+	if len(prog.List) != 2 {
+		t.Fatalf("%s: expected 2 expressions, actual %d", t.Name(), len(prog.List))
+	}
+	decl, ok := prog.List[0].(*assign)
+	if !ok || decl.Name.Name != "f" {
+		t.Fatalf("%s: expected assignment to f, actual %#v", t.Name(), prog.List[0])
+	}
+	if fn, ok := decl.Val.(*funcLit); !ok || len(fn.Params) != 1 || len(fn.Body.List) != 1 {
+		t.Fatalf("%s: unexpected function %#v", t.Name(), decl.Val)
+	}
+	call, ok := prog.List[1].(*callExpr)
+	if !ok || len(call.Args) != 1 {
+		t.Fatalf("%s: expected call, actual %#v", t.Name(), prog.List[1])
+	}
+	if arg, ok := call.Args[0].(*binaryExpr); !ok || arg.Op != tokAdd {
+		t.Fatalf("%s: expected addition, actual %#v", t.Name(), call.Args[0])
+	}
+	if span := call.Span(); span != (Span{Pos{2, 1}, Pos{2, 9}}) {
+		t.Fatalf("%s: unexpected span %v", t.Name(), span)
+	}
+	idents := 0
+	walk(prog, func(n node) bool {
+		if _, ok := n.(*identifier); ok {
+			idents++
+		}
+		return true
+	})
+	checkEqualInt(t, 4, idents)
+}
+
+// sexpr returns the operations of the expression in prefix notation, e.g.
+// (+ 1 (* 2 3)) for 1 + 2 * 3.
+func sexpr(n node) string {
+	switch n := n.(type) {
+	case *binaryExpr:
+		return fmt.Sprintf("(%s %s %s)", token{id: n.Op}, sexpr(n.X), sexpr(n.Y))
+	case *unaryExpr:
+		return fmt.Sprintf("(%s %s)", token{id: n.Op}, sexpr(n.X))
+	case *intLit:
+		return fmt.Sprint(n.Val)
+	case *identifier:
+		return n.Name
+	case *callExpr:
+		return fmt.Sprintf("(call %s)", sexpr(n.Fn))
+	}
+	return fmt.Sprintf("%T", n)
+}
+
+func TestParsePrecedence(t *testing.T) {
+	tests := []struct {
+		src  string
+		tree string
+	}{
+		{"1 - 2 - 3", "(- (- 1 2) 3)"},
+		{"1 + 2 * 3 % 4", "(+ 1 (% (* 2 3) 4))"},
+		{"(1 + 2) * 3", "(* (+ 1 2) 3)"},
+		{"2 ** 3 ** 2", "(** 2 (** 3 2))"},
+		{"-2 ** 2", "(- (** 2 2))"},
+		{"2 ** -x", "(** 2 (- x))"},
+		{"-x * +y", "(* (- x) (+ y))"},
+		{"--x", "(- (- x))"},
+		{"!a == b", "(== (! a) b)"},
+		{"a < b + 1", "(< a (+ b 1))"},
+		{"-f()", "(- (call f))"},
+		{"(f)()", "(call f)"},
+	}
+	for _, test := range tests {
+		prog, err := newParser(strings.NewReader(test.src)).ParseAST()
+		if err != nil {
+			t.Fatalf("%s: %q: %v", t.Name(), test.src, err)
+		}
+		checkEqualString(t, test.tree, sexpr(prog.List[0]))
+	}
+}
+
+func TestUnknownVarHint(t *testing.T) {
+	tests := []struct {
+		src  string
+		hint string
+	}{
+		{"let count = 0; cout", "did you mean `count`?"},
+		// the hidden limit of the loop is not suggested
+		{"for i in 0..3 { j }", "did you mean `i`?"},
+		{"for i in 0..3 { let x = 1; y }", "did you mean `x`?"},
+	}
+	for _, test := range tests {
+		_, err := Compile(test.src, nil)
+		var perr *ParserError
+		if !errors.As(err, &perr) {
+			t.Fatalf("%s: %q: expected parser error, actual %v", t.Name(), test.src, err)
+		}
+		checkEqualString(t, test.hint, perr.Hint())
+	}
+}
+
+func TestAssignErrors(t *testing.T) {
+	tests := []struct {
+		src  string
+		msg  string
+		hint string
+	}{
+		{"x = 1", "Undeclared variable: x at line 1 and position 1", "declare it with `let x = ...`"},
+		{"let count = 0; cout = 1", "Undeclared variable: cout at line 1 and position 16", "did you mean `count`?"},
+		{"const k = 1; k = 2", "Cannot assign to constant: k at line 1 and position 14", ""},
+		{"const k = 1; let f = fn() { k = 2 }", "Cannot assign to constant: k at line 1 and position 29", ""},
+		{"total = 1", "Cannot assign to global: total at line 1 and position 1", ""},
+		{"let x 1", "Unexpected token: 1, = expected at line 1 and position 7", ""},
+		{"var = 1", "Unexpected token: =, ident expected at line 1 and position 5", ""},
+		// declarations are statements, not values
+		{"1 + (let x = 2)", "Unexpected declaration: let, value expected at line 1 and position 6",
+			"declare the variable in a statement before the expression"},
+		{"let y = 10 + (let x = 2); x + y", "Unexpected declaration: let, value expected at line 1 and position 15",
+			"declare the variable in a statement before the expression"},
+		{"let f = fn(a, b) { a + b }; f(let x = 3, x)", "Unexpected declaration: let, value expected at line 1 and position 31",
+			"declare the variable in a statement before the expression"},
+	}
+	for _, test := range tests {
+		_, err := Compile(test.src, &Options{Globals: []string{"total"}})
+		var perr *ParserError
+		if !errors.As(err, &perr) {
+			t.Fatalf("%s: %q: expected parser error, actual %v", t.Name(), test.src, err)
+		}
+		checkEqualString(t, test.msg, perr.Error())
+		checkEqualString(t, test.hint, perr.Hint())
+	}
+}
+
+func TestCodeGenError(t *testing.T) {
+	_, err := newParser(strings.NewReader("break; len(1, 2); return 1")).Parse()
+	list, ok := err.(ErrorList)
+	if !ok || len(list) != 3 {
+		t.Fatalf("%s: expected 3 errors, actual %v", t.Name(), err)
+	}
+	checkEqualString(t, "Not in a loop: break at line 1 and position 1", list[0].Error())
+	checkEqualString(t, "Wrong number of arguments of len: 2, 1 expected at line 1 and position 8", list[1].Error())
+	checkEqualString(t, "Return outside of function at line 1 and position 19", list[2].Error())
+}
@@ -0,0 +1,161 @@
+package popi
+
+import "bytes"
+
+// peephole removes and rewrites short sequences of instructions of the
+// generated code, which do nothing or can be done cheaper:
+//
+//	dup; drop             removed, left by a declaration used as a statement
+//	get n; drop           removed, and so are other pushes followed by drop
+//	dup; set n; drop      set n, left by an assignment used as a statement
+//	pushi a; pushi b; swap   pushi b; pushi a
+//	jmp next              removed
+//
+// Instructions within a sequence other than the first one must not be
+// targets of jumps. Jumps, functions and the line table are updated to the
+// new addresses.
+func peephole(prog *Program) {
+	var (
+		instrs  []instr
+		targets = map[int]bool{}
+		funcs   []*Func
+	)
+	code := newByteCode(prog.code)
+	for code.Addr() < len(prog.code) {
+		in, err := readInstr(code)
+		if err != nil {
+			// generated code is valid, keep it as it is otherwise
+			return
+		}
+		instrs = append(instrs, in)
+		for k, arg := range in.args {
+			if opArgs[in.op][k] == argAddr {
+				targets[arg] = true
+			}
+		}
+	}
+	for _, c := range prog.consts {
+		if c.kind == KindFunc {
+			f := c.ref.(*Func)
+			funcs = append(funcs, f)
+			targets[f.addr] = true
+		}
+	}
+
+	type item struct {
+		instr
+		target bool // the first of the instructions replaced is a target
+	}
+	var (
+		out   []item
+		start = make([]int, len(instrs)) // indexes in out by the old instructions
+	)
+	// trim removes n items from the end of out, the old instructions
+	// starting at them start at the following ones now
+	trim := func(k int, n int) {
+		out = out[:len(out)-n]
+		for j := k; j >= 0 && start[j] > len(out); j-- {
+			start[j] = len(out)
+		}
+	}
+	for k, in := range instrs {
+		start[k] = len(out)
+		target := targets[in.addr]
+		last := len(out) - 1
+		switch {
+		case in.op == opJmp && k+1 < len(instrs) && in.args[0] == instrs[k+1].addr:
+			continue
+		case in.op == opDrop && !target && last >= 0 && isPush(out[last].instr):
+			trim(k, 1)
+			continue
+		case in.op == opDrop && !target && last >= 1 && !out[last].target &&
+			out[last-1].op == opDup && isSet(out[last].instr):
+			out[last-1].instr = out[last].instr
+			start[k-1] = last - 1
+			trim(k, 1)
+			continue
+		case in.op == opSwap && !target && last >= 1 && !out[last].target &&
+			isPlainPush(out[last].instr) && isPlainPush(out[last-1].instr):
+			out[last-1].instr, out[last].instr = out[last].instr, out[last-1].instr
+			continue
+		}
+		out = append(out, item{in, target})
+	}
+
+	// the instructions keep their sizes, as the addresses are u32
+	var buf bytes.Buffer
+	addrs := make([]int, len(out)+1)
+	for n, in := range out {
+		addrs[n] = buf.Len()
+		writeInstr(&buf, in.instr)
+	}
+	addrs[len(out)] = buf.Len()
+	index := make(map[int]int, len(instrs)+1) // old addresses to new ones
+	for k, in := range instrs {
+		index[in.addr] = addrs[start[k]]
+	}
+	index[len(prog.code)] = buf.Len()
+
+	newCode := buf.Bytes()
+	for n, in := range out {
+		for k, arg := range in.args {
+			if opArgs[in.op][k] == argAddr {
+				at := addrs[n+1] - 4
+				addr := index[arg]
+				newCode[at], newCode[at+1], newCode[at+2], newCode[at+3] = byte(addr), byte(addr>>8), byte(addr>>16), byte(addr>>24)
+			}
+		}
+	}
+	for _, f := range funcs {
+		f.addr = index[f.addr]
+	}
+	var lines []lineInfo
+	for _, l := range prog.lines {
+		l.addr = index[l.addr]
+		if n := len(lines); n > 0 && lines[n-1].addr == l.addr {
+			// the code of the previous line was removed
+			lines = lines[:n-1]
+		}
+		if n := len(lines); n > 0 && lines[n-1].span == l.span {
+			continue
+		}
+		lines = append(lines, l)
+	}
+	prog.code = newCode
+	prog.lines = lines
+}
+
+// isPush reports whether the instruction only pushes a value, so it can be
+// dropped right away.
+func isPush(in instr) bool {
+	switch in.op {
+	case opPushI, opPushF, opPushS, opTrue, opFalse, opNil, opFunc, opGet, opGetGlobal, opDup,
+		opGetCell, opGetUpval, opRefUpval:
+		return true
+	}
+	return false
+}
+
+// isSet reports whether the instruction pops the value to a variable, which
+// does not depend on the values on the stack.
+func isSet(in instr) bool {
+	switch in.op {
+	case opSet, opSetCell:
+		return in.args[0] >= 0
+	case opSetUpval:
+		return true
+	}
+	return false
+}
+
+// isPlainPush reports whether the instruction pushes a value regardless of
+// the values on the stack, so it can be swapped with another one. Locals
+// are not, the slot read may be the one pushed by the other instruction,
+// e.g. the variable declared last in a block.
+func isPlainPush(in instr) bool {
+	switch in.op {
+	case opPushI, opPushF, opPushS, opTrue, opFalse, opNil, opFunc, opGetGlobal, opGetUpval, opRefUpval:
+		return true
+	}
+	return false
+}
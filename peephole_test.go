@@ -0,0 +1,152 @@
+package popi
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// listing returns the mnemonics of the instructions of the program.
+func listing(t *testing.T, prog *Program) string {
+	var ops []string
+	code := newByteCode(prog.code)
+	for code.Addr() < len(prog.code) {
+		in, err := readInstr(code)
+		if err != nil {
+			t.Fatalf("%s: %v", t.Name(), err)
+		}
+		ops = append(ops, in.op.String())
+	}
+	return strings.Join(ops, " ")
+}
+
+func TestPeephole(t *testing.T) {
+	tests := []struct {
+		src    string
+		before string
+		after  string
+	}{
+		{
+			"let x = 1; let y = x + 1; let z = y * 2; z",
+			"pushi dup drop get pushi addi dup drop get pushi muli dup drop get",
+			"pushi get pushi addi get pushi muli get",
+		},
+		{
+			"let x = 1; x; 2",
+			"pushi dup drop get drop pushi",
+			"pushi pushi",
+		},
+		{
+			"let f = fn(a) { let b = a; b }; f(1)",
+			"jmp get dup drop get ret func dup drop get pushi call",
+			"jmp get get ret func get pushi call",
+		},
+		{
+			"var x = 0; x = 5; x = x + 1; x",
+			"pushi dup drop seti get drop get pushi add dup set drop get",
+			"pushi seti get pushi add set get",
+		},
+	}
+	for _, test := range tests {
+		prog, err := Compile(test.src, &Options{NoPeephole: true})
+		if err != nil {
+			t.Fatalf("%s: %v", t.Name(), err)
+		}
+		checkEqualString(t, test.before, listing(t, prog))
+		if prog, err = Compile(test.src, nil); err != nil {
+			t.Fatalf("%s: %v", t.Name(), err)
+		}
+		checkEqualString(t, test.after, listing(t, prog))
+	}
+}
+
+func TestPeepholeRewrite(t *testing.T) {
+	tests := []struct {
+		src   string
+		after string
+	}{
+		{"pushi 1\npushi 2\nswap\nsub", "pushi pushi sub"},
+		{"getg total\nnil\nswap", "nil getg"},
+		// the local may be the value pushed before
+		{"getg total\nget 0\nswap", "getg get swap"},
+		{"pushi 5\ndup\ndrop\nget 0\nswap\ndrop", "pushi get swap drop"},
+		// the swap depends on the stack
+		{"nil\nnil\nget -1\npushi 1\nswap", "nil nil get pushi swap"},
+		// jumps into the sequences
+		{"true\njmpf l\npushi 1\nl: pushi 2\nswap", "true jmpf pushi pushi swap"},
+		{"true\njmpf l\nnil\nl: drop", "true jmpf nil drop"},
+		{"true\njmpf l\nnil\nl: nil\ndrop", "true jmpf nil"},
+		{"jmp l\nl: nil", "nil"},
+	}
+	for _, test := range tests {
+		prog := assemble(t, test.src)
+		peephole(prog)
+		checkEqualString(t, test.after, listing(t, prog))
+	}
+	prog := assemble(t, "pushi 1\npushi 2\nswap\nsub")
+	peephole(prog)
+	i := newInterpreter(prog)
+	if err := i.exec(); err != nil {
+		t.Fatalf("%s: %v", t.Name(), err)
+	}
+	checkEqualInt(t, 1, i.popGo().(int))
+}
+
+func TestPeepholeSemantics(t *testing.T) {
+	srcs := []string{
+		"let x = 1; let y = x + 1; let z = y * 2; z",
+		"let f = fn(a, b) { let c = a * b; c + 1 }; let x = f(2, 3); x",
+		"let s = 0; for i in 0..10 { let s = s + i }",
+		"let s = 0; for i in 0..10 { if i == 5 { break }; let x = i; let s = s + x }",
+		"for i in 0..10 { if i > 3 { continue }; let x = i; x * 2 }",
+		"let n = 0; while n < 3 { break }",
+		"let x = 5; if x > 3 { let y = x; y * 2 } else { 0 }",
+		"let x = 5; if x > 30 { 1 }",
+		`let f = fn(x) { let g = fn(y) { y + 1 }; g(x) * 2 }; f(3); f(4)`,
+		"let x = 1; if true { let y = 2; if x < y { let z = 3; x + y + z } }",
+		"let adder = fn(n) { fn(x) { x + n } }; let add2 = adder(2); add2(3)",
+		"let c = 1; let f = fn(a) { fn() { a + c } }; for i in 0..3 { let g = fn() { i + f(i)() }; g() }",
+		"let fib = fn(n) { if n < 2 { return n }; fib(n - 1) + fib(n - 2) }; fib(10)",
+		"var n = 0; let inc = fn() { n = n + 1 }; inc(); inc(); for i in 0..3 { n = n + i }; n",
+		"let r = if true { let t = 5; t } else { 0 }; r",
+		"let a = 1; let b = 2; if a < b { let t = a; t } else { b }",
+	}
+	for _, src := range srcs {
+		var res [2]Value
+		var size [2]int
+		for k, opts := range []*Options{{NoPeephole: true}, nil} {
+			prog, err := Compile(src, opts)
+			if err != nil {
+				t.Fatalf("%s: %s: %v", t.Name(), src, err)
+			}
+			if err = Verify(prog); err != nil {
+				t.Fatalf("%s: %s: %v", t.Name(), src, err)
+			}
+			if res[k], err = NewVM(prog).Run(); err != nil {
+				t.Fatalf("%s: %s: %v", t.Name(), src, err)
+			}
+			size[k] = len(prog.code)
+		}
+		if res[0] != res[1] {
+			t.Fatalf("%s: %s: expected %v, actual %v", t.Name(), src, res[0], res[1])
+		}
+		if size[1] >= size[0] {
+			t.Fatalf("%s: %s: expected less than %d bytes, actual %d", t.Name(), src, size[0], size[1])
+		}
+	}
+}
+
+func TestPeepholeLines(t *testing.T) {
+	prog, err := Compile("let x = 1\nlet y = 2\n\nx / 0", nil)
+	if err != nil {
+		t.Fatalf("%s: %v", t.Name(), err)
+	}
+	_, err = NewVM(prog).Run()
+	var rerr *RuntimeError
+	if !errors.As(err, &rerr) {
+		t.Fatalf("%s: expected runtime error, actual %v", t.Name(), err)
+	}
+	checkEqualInt(t, 4, rerr.Line())
+	checkEqualInt(t, 1, prog.Line(0))
+	checkEqualInt(t, 2, prog.Line(3))
+}
@@ -0,0 +1,290 @@
+package popi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+)
+
+// Version is the version of the compiled program format written by Encode.
+// Decode accepts this version only.
+const Version = 2
+
+// magic starts every compiled program, i.e. a .popc file.
+const magic = "POPC"
+
+// flagLines is set in the header if the debug line table is present.
+const flagLines = 1
+
+var (
+	// ErrVersion is returned by Decode for programs compiled to another
+	// version of the format, they have to be compiled again.
+	ErrVersion = errors.New("Unsupported version of compiled program")
+
+	errNotCompiled = errors.New("Not a compiled popi program")
+	errChecksum    = errors.New("Checksum mismatch")
+	errEndOfData   = errors.New("Unexpected end of data")
+)
+
+// IsCompiled reports whether the data starts like a compiled program.
+func IsCompiled(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(magic))
+}
+
+// Encode serializes the program, so it can be stored and later loaded by
+// Decode without compiling the source again. The layout is
+//
+//	magic    "POPC"
+//	version  u16
+//	flags    byte
+//	name     string
+//	globals  uvarint count, strings
+//	funcs    uvarint count, uvarint address and arity of each function
+//	consts   uvarint count, kind byte and value of each constant
+//	code     uvarint length, bytes
+//	lines    uvarint count, uvarint address and varint line deltas, uvarint
+//	         start column, end line delta and end column, if flagged
+//	crc      u32, IEEE CRC-32 of all the preceding bytes
+//
+// Strings are written as uvarint length and bytes, fixed size integers in
+// little endian. A function constant is written as its index in funcs.
+func Encode(prog *Program) ([]byte, error) {
+	e := &encoder{}
+	e.buf.WriteString(magic)
+	e.writeU16(Version)
+	var flags byte
+	if len(prog.lines) > 0 {
+		flags |= flagLines
+	}
+	e.buf.WriteByte(flags)
+	e.writeString(prog.name)
+	e.writeUvarint(len(prog.globals))
+	for _, global := range prog.globals {
+		e.writeString(global)
+	}
+	var funcs []*Func
+	for _, c := range prog.consts {
+		if c.kind == KindFunc {
+			funcs = append(funcs, c.ref.(*Func))
+		}
+	}
+	e.writeUvarint(len(funcs))
+	for _, f := range funcs {
+		e.writeUvarint(f.addr)
+		e.writeUvarint(f.arity)
+	}
+	e.writeUvarint(len(prog.consts))
+	nfunc := 0
+	for _, c := range prog.consts {
+		e.buf.WriteByte(byte(c.kind))
+		switch c.kind {
+		case KindInt:
+			e.writeVarint(c.Int())
+		case KindFloat:
+			var buf [8]byte
+			binary.LittleEndian.PutUint64(buf[:], c.num)
+			e.buf.Write(buf[:])
+		case KindString:
+			e.writeString(c.String())
+		case KindFunc:
+			e.writeUvarint(nfunc)
+			nfunc++
+		default:
+			return nil, fmt.Errorf("Invalid constant: %s", c.kind)
+		}
+	}
+	e.writeUvarint(len(prog.code))
+	e.buf.Write(prog.code)
+	if flags&flagLines != 0 {
+		e.writeUvarint(len(prog.lines))
+		var addr, line int
+		for _, l := range prog.lines {
+			e.writeUvarint(l.addr - addr)
+			e.writeVarint(l.span.Start.Line - line)
+			e.writeUvarint(l.span.Start.Col)
+			e.writeUvarint(l.span.End.Line - l.span.Start.Line)
+			e.writeUvarint(l.span.End.Col)
+			addr, line = l.addr, l.span.Start.Line
+		}
+	}
+	var crc [4]byte
+	binary.LittleEndian.PutUint32(crc[:], crc32.ChecksumIEEE(e.buf.Bytes()))
+	e.buf.Write(crc[:])
+	return e.buf.Bytes(), nil
+}
+
+type encoder struct {
+	buf bytes.Buffer
+}
+
+func (e *encoder) writeU16(n int) {
+	e.buf.WriteByte(byte(n))
+	e.buf.WriteByte(byte(n >> 8))
+}
+
+func (e *encoder) writeUvarint(n int) {
+	var buf [binary.MaxVarintLen64]byte
+	e.buf.Write(buf[:binary.PutUvarint(buf[:], uint64(n))])
+}
+
+func (e *encoder) writeVarint(n int) {
+	var buf [binary.MaxVarintLen64]byte
+	e.buf.Write(buf[:binary.PutVarint(buf[:], int64(n))])
+}
+
+func (e *encoder) writeString(s string) {
+	e.writeUvarint(len(s))
+	e.buf.WriteString(s)
+}
+
+// Decode loads the program serialized by Encode. Data of another format
+// version are rejected with ErrVersion, corrupted data with an error, as
+// well as code rejected by Verify.
+func Decode(data []byte) (prog *Program, err error) {
+	if !IsCompiled(data) {
+		return nil, errNotCompiled
+	}
+	d := &decoder{newByteCode(data), nil}
+	d.b.SetAddr(len(magic))
+	if version := d.readU16(); d.err == nil && version != Version {
+		return nil, fmt.Errorf("%w: %d, %d expected", ErrVersion, version, Version)
+	}
+	if len(data) < d.b.Addr()+4 {
+		return nil, errEndOfData
+	}
+	body := data[:len(data)-4]
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(data[len(body):]) {
+		return nil, errChecksum
+	}
+	d.b = newByteCode(body)
+	d.b.SetAddr(len(magic) + 2)
+	flags := d.readByte()
+	prog = &Program{name: d.readString()}
+	prog.globals = make([]string, d.readCount())
+	for i := range prog.globals {
+		prog.globals[i] = d.readString()
+	}
+	funcs := make([]*Func, d.readCount())
+	for i := range funcs {
+		funcs[i] = &Func{d.readCount(), d.readCount()}
+	}
+	prog.consts = make([]Value, d.readCount())
+	for i := range prog.consts {
+		switch kind := Kind(d.readByte()); kind {
+		case KindInt:
+			prog.consts[i] = IntValue(d.readVarint())
+		case KindFloat:
+			prog.consts[i] = FloatValue(math.Float64frombits(d.readU64()))
+		case KindString:
+			prog.consts[i] = StringValue(d.readString())
+		case KindFunc:
+			if n := d.readCount(); n < len(funcs) {
+				prog.consts[i] = funcValue(funcs[n])
+			} else {
+				d.fail(fmt.Errorf("Invalid function: %d", n))
+			}
+		default:
+			d.fail(fmt.Errorf("Invalid constant: %s", kind))
+		}
+	}
+	prog.code = d.readBytes(d.readCount())
+	if flags&flagLines != 0 {
+		prog.lines = make([]lineInfo, d.readCount())
+		var addr, line int
+		for i := range prog.lines {
+			addr += d.readCount()
+			line += d.readVarint()
+			start := Pos{line, d.readCount()}
+			end := Pos{line + d.readCount(), d.readCount()}
+			prog.lines[i] = lineInfo{addr, Span{start, end}}
+		}
+	}
+	if d.err == nil && d.b.Addr() != len(body) {
+		d.fail(errors.New("Unexpected data after the program"))
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	if err = Verify(prog); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// decoder reads the values of a compiled program. The first error is kept
+// and the values read after it are zero.
+type decoder struct {
+	b   *byteCode
+	err error
+}
+
+func (d *decoder) fail(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+}
+
+func (d *decoder) readByte() byte {
+	c, err := d.b.ReadByte()
+	if err != nil {
+		d.fail(errEndOfData)
+	}
+	return c
+}
+
+func (d *decoder) readU16() int {
+	n, ok := d.b.ReadU16()
+	if !ok {
+		d.fail(errEndOfData)
+	}
+	return n
+}
+
+func (d *decoder) readU64() uint64 {
+	lo, ok := d.b.ReadU32()
+	hi, ok2 := d.b.ReadU32()
+	if !ok || !ok2 {
+		d.fail(errEndOfData)
+	}
+	return uint64(lo) | uint64(hi)<<32
+}
+
+// readCount reads a uvarint, which has to fit into the remaining data,
+// so corrupted counts do not allocate huge slices.
+func (d *decoder) readCount() int {
+	n, ok := d.b.ReadUvarint()
+	if !ok {
+		d.fail(errEndOfData)
+		return 0
+	}
+	if n > uint64(len(d.b.buf)) {
+		d.fail(fmt.Errorf("Invalid count: %d", n))
+		return 0
+	}
+	return int(n)
+}
+
+func (d *decoder) readVarint() int {
+	n, ok := d.b.ReadVarint()
+	if !ok {
+		d.fail(errEndOfData)
+	}
+	return int(n)
+}
+
+func (d *decoder) readBytes(n int) []byte {
+	if len(d.b.buf)-d.b.Addr() < n {
+		d.fail(errEndOfData)
+		return nil
+	}
+	p := make([]byte, n)
+	d.b.Read(p)
+	return p
+}
+
+func (d *decoder) readString() string {
+	return string(d.readBytes(d.readCount()))
+}
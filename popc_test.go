@@ -0,0 +1,118 @@
+package popi
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+const popcSrc = `let greet = fn(s) { "hello " + s }
+let f = fn(x, rate) {
+	x * rate + total
+}
+greet("x")
+f(0 - 10, 0.5)`
+
+func compilePopc(t *testing.T) *Program {
+	prog, err := Compile(popcSrc, &Options{Name: "rules.popi", Globals: []string{"total"}})
+	if err != nil {
+		t.Fatalf("%s: %v", t.Name(), err)
+	}
+	return prog
+}
+
+func TestEncodeDecode(t *testing.T) {
+	prog := compilePopc(t)
+	data, err := Encode(prog)
+	if err != nil {
+		t.Fatalf("%s: %v", t.Name(), err)
+	}
+	if !IsCompiled(data) {
+		t.Fatalf("%s: expected magic, actual %q", t.Name(), data[:4])
+	}
+	loaded, err := Decode(data)
+	if err != nil {
+		t.Fatalf("%s: %v", t.Name(), err)
+	}
+	checkEqualString(t, "rules.popi", loaded.Name())
+	if !reflect.DeepEqual(prog, loaded) {
+		t.Fatalf("%s: expected %+v, actual %+v", t.Name(), prog, loaded)
+	}
+	vm := NewVM(loaded)
+	vm.SetGlobal("total", 100)
+	res, err := vm.Run()
+	if err != nil {
+		t.Fatalf("%s: %v", t.Name(), err)
+	}
+	checkEqualFloat(t, 95, res.Float())
+
+	// the encoding is stable
+	again, _ := Encode(loaded)
+	if !bytes.Equal(data, again) {
+		t.Fatalf("%s: encoding of decoded program differs", t.Name())
+	}
+}
+
+func TestDecodeLines(t *testing.T) {
+	prog, err := Compile("let x = 1\n\nx / 0", nil)
+	if err != nil {
+		t.Fatalf("%s: %v", t.Name(), err)
+	}
+	lines := prog.lines
+	data, _ := Encode(prog)
+	if prog, err = Decode(data); err != nil {
+		t.Fatalf("%s: %v", t.Name(), err)
+	}
+	if !reflect.DeepEqual(lines, prog.lines) {
+		t.Fatalf("%s: expected %v, actual %v", t.Name(), lines, prog.lines)
+	}
+	_, err = NewVM(prog).Run()
+	var rerr *RuntimeError
+	if !errors.As(err, &rerr) {
+		t.Fatalf("%s: expected runtime error, actual %v", t.Name(), err)
+	}
+	checkEqualInt(t, 3, rerr.Line())
+	if span := rerr.Span(); span != (Span{Pos{3, 1}, Pos{3, 6}}) {
+		t.Fatalf("%s: unexpected span %v", t.Name(), span)
+	}
+
+	// programs without debug info are encoded without the line table
+	prog.lines = nil
+	data, _ = Encode(prog)
+	if prog, err = Decode(data); err != nil {
+		t.Fatalf("%s: %v", t.Name(), err)
+	}
+	checkEqualInt(t, 0, prog.Line(0))
+}
+
+func TestDecodeErrors(t *testing.T) {
+	data, err := Encode(compilePopc(t))
+	if err != nil {
+		t.Fatalf("%s: %v", t.Name(), err)
+	}
+
+	_, err = Decode([]byte(popcSrc))
+	checkEqualString(t, "Not a compiled popi program", err.Error())
+
+	version := append([]byte(nil), data...)
+	version[4] = Version + 1
+	_, err = Decode(version)
+	if !errors.Is(err, ErrVersion) {
+		t.Fatalf("%s: expected version error, actual %v", t.Name(), err)
+	}
+	checkEqualString(t, "Unsupported version of compiled program: 3, 2 expected", err.Error())
+
+	corrupt := append([]byte(nil), data...)
+	corrupt[len(corrupt)/2] ^= 0xff
+	_, err = Decode(corrupt)
+	checkEqualString(t, "Checksum mismatch", err.Error())
+
+	for _, n := range []int{4, 6, 10, len(data) - 1} {
+		if _, err = Decode(data[:n]); err == nil {
+			t.Fatalf("%s: expected error for %d bytes", t.Name(), n)
+		}
+	}
+	_, err = Decode(data[:5])
+	checkEqualString(t, "Unexpected end of data", err.Error())
+}
@@ -1,24 +1,180 @@
-package main
+// Package popi implements a small expression language, which can be
+// embedded in Go programs. The source is compiled to a Program, which is
+// run by a VM:
+//
+//	src := "total * rate"
+//	prog, err := popi.Compile(src, &popi.Options{Globals: []string{"total", "rate"}})
+//	if err != nil {
+//		fmt.Print(popi.FormatError("rules", src, err))
+//		return
+//	}
+//	vm := popi.NewVM(prog)
+//	vm.SetGlobal("total", 120)
+//	vm.SetGlobal("rate", 0.2)
+//	res, err := vm.Run()
+//	fmt.Println(res.Float())
+//
+// Values of programs are Value. Hosts pass Go values in, which are
+// converted by ValueOf, and read the results by the Value methods, or as
+// Go values by Value.Interface. Integer and float types are converted to
+// int and float64. Structs, pointers, slices, arrays and maps are bound by
+// reflection, programs read their fields (order.total reads the field
+// Total or the one tagged `popi:"total"`), call their methods and index
+// their elements. Functions are opaque values, which can only be passed
+// back to the program.
+//
+// Go functions are made callable from programs by VM.Register:
+//
+//	vm.Register("now", 0, func(args []popi.Value) (popi.Value, error) {
+//		return popi.IntValue(int(time.Now().Unix())), nil
+//	})
+//
+// Programs are serialized by Encode, e.g. to .popc files at deploy time,
+// and loaded by Decode without compiling the source again.
+package popi
 
 import (
 	"fmt"
+	"sort"
 	"strings"
 )
 
-func main() {
-	p := NewParser(strings.NewReader("f = fn(a, b) { a + b }"))
-	code, err := p.Parse()
-	if err != nil {
-		fmt.Println(err)
+// Options of the compilation.
+type Options struct {
+	// Name of the source used in diagnostics.
+	Name string
+	// Globals are the names of the variables set by the host before the
+	// program runs, including the native functions registered by the host.
+	// Programs can read them, also within functions.
+	Globals []string
+	// NoPeephole disables the peephole optimizer, so the code is listed by
+	// Disassemble as generated, e.g. for debugging the code generator.
+	NoPeephole bool
+}
+
+// Program is a compiled source, which can be run by any number of VMs.
+type Program struct {
+	name    string
+	code    []byte
+	consts  []Value // constant pool referenced by the code
+	globals []string
+	lines   []lineInfo // sorted by addr, empty without debug info
+}
+
+// lineInfo maps the code from addr up to the next lineInfo to the span of
+// the source it was compiled from. Columns are 0 if only the line is known,
+// e.g. of assembled code.
+type lineInfo struct {
+	addr int
+	span Span
+}
+
+// Compile compiles the source. The options may be nil. All errors found
+// are returned in ErrorList, FormatError renders them for the user.
+func Compile(src string, opts *Options) (prog *Program, err error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	globals := append([]string(nil), opts.Globals...)
+	p := newParser(strings.NewReader(src))
+	if prog, err = p.parse(newCodeGen(globals...)); err != nil {
 		return
 	}
-	i := NewInterpreter(code)
-	if err := i.Exec(); err != nil {
-		fmt.Println(err)
+	if !opts.NoPeephole {
+		peephole(prog)
+	}
+	prog.name = opts.Name
+	return
+}
+
+// Name returns the name of the source given in Options.
+func (prog *Program) Name() string {
+	return prog.name
+}
+
+// Line returns the line of the source the code at the address was
+// compiled from, or 0 if it is not known.
+func (prog *Program) Line(addr int) int {
+	return spanAt(prog.lines, addr).Start.Line
+}
+
+// spanAt returns the span of the source of the code at the address, the
+// zero span if it is not known.
+func spanAt(lines []lineInfo, addr int) Span {
+	n := sort.Search(len(lines), func(i int) bool { return lines[i].addr > addr })
+	if n == 0 {
+		return Span{}
+	}
+	return lines[n-1].span
+}
+
+// Globals returns the names of the globals of the program.
+func (prog *Program) Globals() []string {
+	return append([]string(nil), prog.globals...)
+}
+
+// VM runs a program. Globals keep their values between runs.
+type VM struct {
+	prog    *Program
+	globals []Value
+}
+
+// NewVM returns a VM for the program with all globals set to nil.
+func NewVM(prog *Program) *VM {
+	return &VM{prog, make([]Value, len(prog.globals))}
+}
+
+// SetGlobal sets the global declared in Options to the Go value converted
+// by ValueOf.
+func (vm *VM) SetGlobal(name string, val interface{}) (err error) {
+	var idx int
+	if idx, err = vm.findGlobal(name); err != nil {
+		return
+	}
+	if vm.globals[idx], err = ValueOf(val); err != nil {
+		return fmt.Errorf("Global %s: %w", name, err)
+	}
+	return
+}
+
+// Register sets the global declared in Options to the Go function. Calls
+// with other than arity arguments fail, unless the arity is -1. An error
+// returned by the function stops the program with RuntimeError, which
+// wraps the error.
+func (vm *VM) Register(name string, arity int, fn NativeFunc) (err error) {
+	var idx int
+	if idx, err = vm.findGlobal(name); err != nil {
 		return
 	}
-	fmt.Println("stack:")
-	for x := i.Pop(); x != nil; x = i.Pop() {
-		fmt.Println(x)
+	vm.globals[idx] = nativeValue(&Native{name, arity, fn})
+	return
+}
+
+// Global returns the value of the global, nil if it is not declared.
+func (vm *VM) Global(name string) Value {
+	idx, err := vm.findGlobal(name)
+	if err != nil {
+		return Value{}
+	}
+	return vm.globals[idx]
+}
+
+func (vm *VM) findGlobal(name string) (idx int, err error) {
+	for i, global := range vm.prog.globals {
+		if global == name {
+			return i, nil
+		}
+	}
+	return -1, fmt.Errorf("Unknown global: %s", name)
+}
+
+// Run runs the program and returns the value of its last expression.
+// A failing instruction stops the program with RuntimeError.
+func (vm *VM) Run() (res Value, err error) {
+	i := newInterpreter(vm.prog)
+	i.globals = vm.globals
+	if err = i.exec(); err != nil {
+		return
 	}
+	return i.pop()
 }
@@ -0,0 +1,146 @@
+package popi
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCompileRun(t *testing.T) {
+	prog, err := Compile("let f = fn(a, b) { a + b }; f(1, 2)", nil)
+	if err != nil {
+		t.Fatalf("%s: %v", t.Name(), err)
+	}
+	res, err := NewVM(prog).Run()
+	if err != nil {
+		t.Fatalf("%s: %v", t.Name(), err)
+	}
+	if res.Interface() != 3 {
+		t.Fatalf("%s: expected 3, actual %v", t.Name(), res)
+	}
+}
+
+func TestGlobals(t *testing.T) {
+	prog, err := Compile(`let discount = fn(x) { if x > limit { x * rate } else { 0 } }
+discount(total)`, &Options{Name: "rules", Globals: []string{"total", "limit", "rate"}})
+	if err != nil {
+		t.Fatalf("%s: %v", t.Name(), err)
+	}
+	vm := NewVM(prog)
+	if err = vm.SetGlobal("total", int64(200)); err != nil {
+		t.Fatalf("%s: %v", t.Name(), err)
+	}
+	vm.SetGlobal("limit", 100)
+	vm.SetGlobal("rate", 0.5)
+	res, err := vm.Run()
+	if err != nil {
+		t.Fatalf("%s: %v", t.Name(), err)
+	}
+	if res.Interface() != 100.0 {
+		t.Fatalf("%s: expected 100.0, actual %v", t.Name(), res)
+	}
+	vm.SetGlobal("total", 50)
+	if res, err = vm.Run(); err != nil || res.Interface() != 0 {
+		t.Fatalf("%s: expected 0, actual %v, %v", t.Name(), res, err)
+	}
+	checkEqualInt(t, 50, vm.Global("total").Int())
+}
+
+func TestGlobalErrors(t *testing.T) {
+	prog, err := Compile("totl", &Options{Globals: []string{"total"}})
+	var perr *ParserError
+	if !errors.As(err, &perr) {
+		t.Fatalf("%s: expected parser error, actual %v", t.Name(), err)
+	}
+	checkEqualString(t, "did you mean `total`?", perr.Hint())
+	if prog, err = Compile("total", &Options{Globals: []string{"total"}}); err != nil {
+		t.Fatalf("%s: %v", t.Name(), err)
+	}
+	vm := NewVM(prog)
+	if err = vm.SetGlobal("totl", 1); err == nil {
+		t.Fatalf("%s: expected unknown global error", t.Name())
+	}
+	if err = vm.SetGlobal("total", make(chan int)); err == nil {
+		t.Fatalf("%s: expected unsupported value error", t.Name())
+	}
+	if res, err := vm.Run(); err != nil || res.Kind() != KindNil {
+		t.Fatalf("%s: expected nil, actual %v, %v", t.Name(), res, err)
+	}
+}
+
+func TestTailCallNative(t *testing.T) {
+	prog, err := Compile("let f = fn(x) { if x > 1 { twice(x) } else { 0 } }; f(2) + f(3) + 1", &Options{Globals: []string{"twice"}})
+	if err != nil {
+		t.Fatalf("%s: %v", t.Name(), err)
+	}
+	vm := NewVM(prog)
+	vm.Register("twice", 1, func(args []Value) (Value, error) {
+		return IntValue(args[0].Int() * 2), nil
+	})
+	res, err := vm.Run()
+	if err != nil {
+		t.Fatalf("%s: %v", t.Name(), err)
+	}
+	checkEqualInt(t, 11, res.Int())
+}
+
+func TestRegister(t *testing.T) {
+	prog, err := Compile("let f = fn(x) { twice(x) + 1 }; f(sum(1, 2, 3))", &Options{Globals: []string{"twice", "sum"}})
+	if err != nil {
+		t.Fatalf("%s: %v", t.Name(), err)
+	}
+	vm := NewVM(prog)
+	vm.Register("twice", 1, func(args []Value) (Value, error) {
+		return IntValue(args[0].Int() * 2), nil
+	})
+	vm.Register("sum", -1, func(args []Value) (Value, error) {
+		n := 0
+		for _, arg := range args {
+			n += arg.Int()
+		}
+		return IntValue(n), nil
+	})
+	res, err := vm.Run()
+	if err != nil {
+		t.Fatalf("%s: %v", t.Name(), err)
+	}
+	if res.Interface() != 13 {
+		t.Fatalf("%s: expected 13, actual %v", t.Name(), res)
+	}
+}
+
+func TestRegisterErrors(t *testing.T) {
+	errLimit := errors.New("Limit exceeded")
+	tests := []struct {
+		src string
+		msg string
+	}{
+		{"check(1, 2)", "Wrong number of arguments: 2, 1 expected"},
+		{"check(1)", "check: Limit exceeded"},
+		{"check(0)", "check: Unsupported value: chan int"},
+	}
+	for _, test := range tests {
+		prog, err := Compile(test.src, &Options{Globals: []string{"check"}})
+		if err != nil {
+			t.Fatalf("%s: %v", t.Name(), err)
+		}
+		vm := NewVM(prog)
+		vm.Register("check", 1, func(args []Value) (Value, error) {
+			if args[0].Int() == 0 {
+				return ValueOf(make(chan int))
+			}
+			return Value{}, errLimit
+		})
+		_, err = vm.Run()
+		var rerr *RuntimeError
+		if !errors.As(err, &rerr) {
+			t.Fatalf("%s: %s: expected runtime error, actual %v", t.Name(), test.src, err)
+		}
+		checkEqualString(t, test.msg, rerr.Msg())
+		if test.msg == "check: Limit exceeded" && !errors.Is(err, errLimit) {
+			t.Fatalf("%s: %s: expected wrapped error, actual %v", t.Name(), test.src, err)
+		}
+	}
+	if err := NewVM(&Program{}).Register("check", 1, nil); err == nil {
+		t.Fatalf("%s: expected unknown global error", t.Name())
+	}
+}
@@ -0,0 +1,121 @@
+package popi
+
+// resolveVars returns the idents declaring the variables used by functions
+// defined in their scope, i.e. the variables codeGen keeps in cells, so the
+// closures of the functions share them with the enclosing function, and
+// the idents declaring the variables assigned after the declaration, whose
+// type is not known at compile time. The scopes are the ones of codeGen:
+// blocks, functions and for loops, a variable is in scope after its
+// declaration, or in the function declared by it already, so the function
+// can call itself.
+func resolveVars(prog *block) (captured, assigned map[*identifier]bool) {
+	r := &resolver{captured: map[*identifier]bool{}, assigned: map[*identifier]bool{}}
+	for _, n := range prog.List {
+		r.resolve(n)
+	}
+	return r.captured, r.assigned
+}
+
+type resolver struct {
+	vars     []resolvedVar // variables in scope, the innermost last
+	fn       int           // depth of the function being resolved
+	captured map[*identifier]bool
+	assigned map[*identifier]bool
+}
+
+type resolvedVar struct {
+	ident *identifier
+	fn    int // depth of the function defining the variable
+}
+
+func (r *resolver) resolve(n node) {
+	switch n := n.(type) {
+	case *identifier:
+		r.lookup(n)
+	case *binaryExpr:
+		r.resolve(n.X)
+		r.resolve(n.Y)
+	case *unaryExpr:
+		r.resolve(n.X)
+	case *assign:
+		if n.Tok == 0 {
+			r.resolve(n.Val)
+			if ident := r.lookup(n.Name); ident != nil {
+				r.assigned[ident] = true
+			}
+			break
+		}
+		if _, ok := n.Val.(*funcLit); ok {
+			r.define(n.Name)
+			r.resolve(n.Val)
+			break
+		}
+		r.resolve(n.Val)
+		r.define(n.Name)
+	case *funcLit:
+		mark := len(r.vars)
+		r.fn++
+		for _, param := range n.Params {
+			r.define(param)
+		}
+		for _, x := range n.Body.List {
+			r.resolve(x)
+		}
+		r.fn--
+		r.vars = r.vars[:mark]
+	case *callExpr:
+		r.resolve(n.Fn)
+		for _, arg := range n.Args {
+			r.resolve(arg)
+		}
+	case *selectorExpr:
+		r.resolve(n.X)
+	case *indexExpr:
+		r.resolve(n.X)
+		r.resolve(n.Index)
+	case *block:
+		mark := len(r.vars)
+		for _, x := range n.List {
+			r.resolve(x)
+		}
+		r.vars = r.vars[:mark]
+	case *ifExpr:
+		r.resolve(n.Cond)
+		r.resolve(n.Then)
+		if n.Else != nil {
+			r.resolve(n.Else)
+		}
+	case *whileExpr:
+		r.resolve(n.Cond)
+		r.resolve(n.Body)
+	case *forExpr:
+		mark := len(r.vars)
+		r.resolve(n.From)
+		r.define(n.Var)
+		r.resolve(n.To)
+		r.resolve(n.Body)
+		r.vars = r.vars[:mark]
+	case *returnExpr:
+		if n.Val != nil {
+			r.resolve(n.Val)
+		}
+	}
+}
+
+// lookup returns the ident declaring the variable referred to, or nil if it
+// is not in scope.
+func (r *resolver) lookup(ident *identifier) *identifier {
+	for k := len(r.vars) - 1; k >= 0; k-- {
+		if v := r.vars[k]; v.ident.Name == ident.Name {
+			if v.fn < r.fn {
+				r.captured[v.ident] = true
+			}
+			return v.ident
+		}
+	}
+	return nil
+}
+
+func (r *resolver) define(ident *identifier) {
+	r.vars = append(r.vars, resolvedVar{ident, r.fn})
+}
@@ -1,70 +1,182 @@
-package main
+package popi
 
-import "fmt"
+import (
+	"fmt"
+	"strconv"
+)
 
 const (
-	TokNone = iota
-	TokInt
-	TokFloat
-	TokAdd
-	TokSub
-	TokMul
-	TokDiv
-	TokLParen
-	TokRParen
-	TokLBrace
-	TokRBrace
-	TokComma
-	TokSColon
-	TokFn
-	TokIdent
-	TokAssign
-	TokEqual
-	TokEOF
+	tokNone = iota
+	tokInt
+	tokFloat
+	tokAdd
+	tokSub
+	tokMul
+	tokDiv
+	tokLParen
+	tokRParen
+	tokLBrace
+	tokRBrace
+	tokComma
+	tokSColon
+	tokFn
+	tokIdent
+	tokAssign
+	tokEqual
+	tokNotEqual
+	tokLess
+	tokLessEqual
+	tokGreater
+	tokGreaterEqual
+	tokIf
+	tokElse
+	tokTrue
+	tokFalse
+	tokWhile
+	tokFor
+	tokIn
+	tokBreak
+	tokContinue
+	tokRange
+	tokString
+	tokDot
+	tokLBracket
+	tokRBracket
+	tokReturn
+	tokLet
+	tokVar
+	tokConst
+	tokMod
+	tokPow
+	tokNot
+	tokEOF
 )
 
-type Token struct {
-	id  int
-	val interface{}
+var keywords = map[string]int{
+	"fn":       tokFn,
+	"if":       tokIf,
+	"else":     tokElse,
+	"true":     tokTrue,
+	"false":    tokFalse,
+	"while":    tokWhile,
+	"for":      tokFor,
+	"in":       tokIn,
+	"break":    tokBreak,
+	"continue": tokContinue,
+	"return":   tokReturn,
+	"let":      tokLet,
+	"var":      tokVar,
+	"const":    tokConst,
+}
+
+// Pos is a position in the source, line and column are counted from 1.
+type Pos struct {
+	Line int
+	Col  int
+}
+
+// Span is a range of the source from Start up to End, which is the
+// position after the last char of the range.
+type Span struct {
+	Start Pos
+	End   Pos
+}
+
+type token struct {
+	id   int
+	val  interface{}
+	span Span
 }
 
-func (t Token) String() string {
+func (t token) String() string {
 	switch t.id {
-	case TokNone:
+	case tokNone:
 		return "None"
-	case TokInt:
+	case tokInt:
 		return fmt.Sprintf("%d", t.val.(int))
-	case TokFloat:
+	case tokFloat:
 		return fmt.Sprintf("%f", t.val.(float64))
-	case TokAdd:
+	case tokAdd:
 		return "+"
-	case TokSub:
+	case tokSub:
 		return "-"
-	case TokMul:
+	case tokMul:
 		return "*"
-	case TokDiv:
+	case tokDiv:
 		return "/"
-	case TokLParen:
+	case tokLParen:
 		return "("
-	case TokRParen:
+	case tokRParen:
 		return ")"
-	case TokLBrace:
+	case tokLBrace:
 		return "{"
-	case TokRBrace:
+	case tokRBrace:
 		return "}"
-	case TokComma:
+	case tokComma:
 		return ","
-	case TokSColon:
+	case tokSColon:
 		return ";"
-	case TokFn:
+	case tokFn:
 		return "fn"
-	case TokIdent:
+	case tokIdent:
 		return t.val.(string)
-	case TokAssign:
+	case tokAssign:
 		return "="
-	case TokEqual:
+	case tokEqual:
 		return "=="
-	case TokEOF:
+	case tokNotEqual:
+		return "!="
+	case tokLess:
+		return "<"
+	case tokLessEqual:
+		return "<="
+	case tokGreater:
+		return ">"
+	case tokGreaterEqual:
+		return ">="
+	case tokIf:
+		return "if"
+	case tokElse:
+		return "else"
+	case tokTrue:
+		return "true"
+	case tokFalse:
+		return "false"
+	case tokWhile:
+		return "while"
+	case tokFor:
+		return "for"
+	case tokIn:
+		return "in"
+	case tokBreak:
+		return "break"
+	case tokContinue:
+		return "continue"
+	case tokRange:
+		return ".."
+	case tokString:
+		return strconv.Quote(t.val.(string))
+	case tokDot:
+		return "."
+	case tokLBracket:
+		return "["
+	case tokRBracket:
+		return "]"
+	case tokReturn:
+		return "return"
+	case tokLet:
+		return "let"
+	case tokVar:
+		return "var"
+	case tokConst:
+		return "const"
+	case tokMod:
+		return "%"
+	case tokPow:
+		return "**"
+	case tokNot:
+		return "!"
+	case tokEOF:
 		return "EOF"
 	default:
 		panic(fmt.Errorf("Unknown token: %d", t.id))
@@ -0,0 +1,192 @@
+package popi
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+)
+
+// Kind is the kind of a Value.
+type Kind byte
+
+const (
+	KindNil Kind = iota
+	KindInt
+	KindFloat
+	KindBool
+	KindString
+	KindFunc
+	KindNative
+	KindObject
+	KindClosure
+	// kindCell is a variable captured by closures, it is never seen by
+	// programs as they use the value in the cell.
+	kindCell
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindNil:
+		return "nil"
+	case KindInt:
+		return "int"
+	case KindFloat:
+		return "float"
+	case KindBool:
+		return "bool"
+	case KindString:
+		return "string"
+	case KindFunc, KindNative, KindClosure:
+		return "function"
+	case KindObject:
+		return "object"
+	default:
+		return fmt.Sprintf("%d", k)
+	}
+}
+
+// Value is a value of a program. Numbers and bools are kept in place, so
+// they are passed around without allocations, strings, functions and host
+// objects are referenced. The zero Value is nil.
+type Value struct {
+	kind Kind
+	num  uint64      // int64 or float64 bits, 1 for true
+	ref  interface{} // string, *Func, *Native, Object, *Closure or *cell
+}
+
+func IntValue(n int) Value {
+	return Value{kind: KindInt, num: uint64(n)}
+}
+
+func FloatValue(n float64) Value {
+	return Value{kind: KindFloat, num: math.Float64bits(n)}
+}
+
+func BoolValue(b bool) Value {
+	if b {
+		return Value{kind: KindBool, num: 1}
+	}
+	return Value{kind: KindBool}
+}
+
+func StringValue(s string) Value {
+	return Value{kind: KindString, ref: s}
+}
+
+func funcValue(f *Func) Value {
+	return Value{kind: KindFunc, ref: f}
+}
+
+func closureValue(c *Closure) Value {
+	return Value{kind: KindClosure, ref: c}
+}
+
+func nativeValue(f *Native) Value {
+	return Value{kind: KindNative, ref: f}
+}
+
+func objectValue(o Object) Value {
+	return Value{kind: KindObject, ref: o}
+}
+
+func (v Value) Kind() Kind {
+	return v.kind
+}
+
+// Int returns the int value, 0 if the value is not an int.
+func (v Value) Int() int {
+	if v.kind != KindInt {
+		return 0
+	}
+	return int(v.num)
+}
+
+// Float returns the float value, 0 if the value is not a float.
+func (v Value) Float() float64 {
+	if v.kind != KindFloat {
+		return 0
+	}
+	return math.Float64frombits(v.num)
+}
+
+// Bool returns the bool value, false if the value is not a bool.
+func (v Value) Bool() bool {
+	return v.kind == KindBool && v.num != 0
+}
+
+// String returns the string value, values of other kinds are formatted.
+func (v Value) String() string {
+	switch v.kind {
+	case KindNil:
+		return "nil"
+	case KindInt:
+		return strconv.Itoa(v.Int())
+	case KindFloat:
+		return strconv.FormatFloat(v.Float(), 'g', -1, 64)
+	case KindBool:
+		return strconv.FormatBool(v.Bool())
+	case KindString:
+		return v.ref.(string)
+	}
+	return fmt.Sprint(v.ref)
+}
+
+// Interface returns the value as a Go value: nil, int, float64, bool,
+// string, the Go value of a bound object, or an opaque function.
+func (v Value) Interface() interface{} {
+	switch v.kind {
+	case KindNil:
+		return nil
+	case KindInt:
+		return v.Int()
+	case KindFloat:
+		return v.Float()
+	case KindBool:
+		return v.Bool()
+	case KindObject:
+		return v.ref.(Object).val.Interface()
+	}
+	return v.ref
+}
+
+// box returns the value as used by interpreter.popGo, i.e. like Interface,
+// but with Nil for nil and Object for bound objects.
+func (v Value) box() interface{} {
+	switch v.kind {
+	case KindNil:
+		return Nil{}
+	case KindObject:
+		return v.ref
+	}
+	return v.Interface()
+}
+
+// ValueOf converts a Go value to Value. Other integer and float types are
+// converted to int and float64, structs, pointers, slices, arrays and maps
+// are bound by reflection, Go functions become native functions.
+func ValueOf(val interface{}) (Value, error) {
+	switch val := val.(type) {
+	case nil, Nil:
+		return Value{}, nil
+	case Value:
+		return val, nil
+	case int:
+		return IntValue(val), nil
+	case float64:
+		return FloatValue(val), nil
+	case bool:
+		return BoolValue(val), nil
+	case string:
+		return StringValue(val), nil
+	case *Func:
+		return funcValue(val), nil
+	case *Closure:
+		return closureValue(val), nil
+	case *Native:
+		return nativeValue(val), nil
+	case Object:
+		return objectValue(val), nil
+	}
+	return reflectValue(reflect.ValueOf(val))
+}
@@ -0,0 +1,54 @@
+package popi
+
+import (
+	"testing"
+	"unsafe"
+)
+
+func TestValueOf(t *testing.T) {
+	type cents int32
+	tests := []struct {
+		val  interface{}
+		kind Kind
+		str  string
+	}{
+		{nil, KindNil, "nil"},
+		{42, KindInt, "42"},
+		{cents(-5), KindInt, "-5"},
+		{uint8(7), KindInt, "7"},
+		{float32(0.5), KindFloat, "0.5"},
+		{true, KindBool, "true"},
+		{"abc", KindString, "abc"},
+		{[]int{1, 2}, KindObject, "[1 2]"},
+		{func() {}, KindNative, "native fn func()"},
+	}
+	for _, test := range tests {
+		v, err := ValueOf(test.val)
+		if err != nil {
+			t.Fatalf("%s: %v: %v", t.Name(), test.val, err)
+		}
+		if v.Kind() != test.kind || v.String() != test.str {
+			t.Fatalf("%s: %v: unexpected value %s %q", t.Name(), test.val, v.Kind(), v)
+		}
+	}
+	if _, err := ValueOf(make(chan int)); err == nil {
+		t.Fatalf("%s: expected unsupported value error", t.Name())
+	}
+}
+
+func TestValueAccessors(t *testing.T) {
+	checkEqualInt(t, -3, IntValue(-3).Int())
+	checkEqualFloat(t, 1.5, FloatValue(1.5).Float())
+	checkEqualBool(t, true, BoolValue(true).Bool())
+	checkEqualString(t, "x", StringValue("x").String())
+	checkEqualInt(t, 0, FloatValue(1.5).Int())
+	if v := (Value{}); v.Kind() != KindNil || v.Interface() != nil {
+		t.Fatalf("%s: zero value is not nil", t.Name())
+	}
+	if IntValue(2).Interface() != 2 || FloatValue(2).Interface() != 2.0 {
+		t.Fatalf("%s: unexpected Go values", t.Name())
+	}
+	if size := unsafe.Sizeof(Value{}); size > 32 {
+		t.Fatalf("%s: value takes %d bytes", t.Name(), size)
+	}
+}
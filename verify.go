@@ -0,0 +1,221 @@
+package popi
+
+import (
+	"fmt"
+	"io"
+)
+
+// VerifyError is an error of the code found by Verify.
+type VerifyError struct {
+	op   opCode
+	addr int
+	msg  string
+}
+
+func (err *VerifyError) Error() string {
+	if err.op == 0 {
+		// the end of the code
+		return fmt.Sprintf("%s at address %d", err.msg, err.addr)
+	}
+	return fmt.Sprintf("%s at address %d (%s)", err.msg, err.addr, err.op)
+}
+
+// Op returns the mnemonic of the instruction, empty at the end of the code.
+func (err *VerifyError) Op() string {
+	if err.op == 0 {
+		return ""
+	}
+	return err.op.String()
+}
+
+func (err *VerifyError) Addr() int {
+	return err.addr
+}
+
+func (err *VerifyError) Msg() string {
+	return err.msg
+}
+
+// Verify checks the code of the program without running it: all opcodes
+// are known, constants and globals referenced exist and are of the kind
+// expected, jumps and functions start at instructions, and the stack
+// never underflows and has the same depth wherever paths of the code
+// merge. Programs loaded by Decode are verified, programs returned by
+// Compile are valid.
+func Verify(prog *Program) error {
+	v := &verifier{prog: prog, instrs: map[int]instr{}}
+	if err := v.decode(); err != nil {
+		return err
+	}
+	if err := v.walk(0, 0, false); err != nil {
+		return err
+	}
+	for _, c := range prog.consts {
+		if c.kind != KindFunc {
+			continue
+		}
+		f := c.ref.(*Func)
+		if _, ok := v.instrs[f.addr]; !ok {
+			return &VerifyError{opFunc, f.addr, "Function does not start at an instruction"}
+		}
+		if err := v.walk(f.addr, f.arity, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type verifier struct {
+	prog   *Program
+	instrs map[int]instr // by address
+}
+
+// constKinds are the kinds of the constants referenced by the opcodes.
+var constKinds = map[opCode]Kind{
+	opPushI:   KindInt,
+	opPushF:   KindFloat,
+	opPushS:   KindString,
+	opFunc:    KindFunc,
+	opField:   KindString,
+	opSetI:    KindInt,
+	opSetF:    KindFloat,
+	opClosure: KindFunc,
+}
+
+// decode decodes all the instructions and checks their operands, which do
+// not depend on the stack.
+func (v *verifier) decode() error {
+	var list []instr
+	code := newByteCode(v.prog.code)
+	for {
+		in, err := readInstr(code)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return &VerifyError{in.op, in.addr, err.Error()}
+		}
+		v.instrs[in.addr] = in
+		list = append(list, in)
+	}
+	for _, in := range list {
+		for k, arg := range in.args {
+			var msg string
+			switch opArgs[in.op][k] {
+			case argConst:
+				if arg >= len(v.prog.consts) || v.prog.consts[arg].kind != constKinds[in.op] {
+					msg = fmt.Sprintf("Invalid constant: %d", arg)
+				}
+			case argCount:
+				if in.op == opGetGlobal && arg >= len(v.prog.globals) {
+					msg = fmt.Sprintf("Invalid global: %d", arg)
+				}
+			case argAddr:
+				if _, ok := v.instrs[arg]; !ok && arg != len(v.prog.code) {
+					msg = fmt.Sprintf("Invalid address: %d", arg)
+				}
+			}
+			if msg != "" {
+				return &VerifyError{in.op, in.addr, msg}
+			}
+		}
+	}
+	return nil
+}
+
+// walk follows all the paths of the code from the entry, where the stack
+// has the depth given, i.e. the number of the arguments of a function.
+func (v *verifier) walk(entry int, depth int, fn bool) error {
+	type path struct {
+		addr  int
+		depth int
+	}
+	depths := map[int]int{}
+	paths := []path{{entry, depth}}
+	for len(paths) > 0 {
+		p := paths[len(paths)-1]
+		paths = paths[:len(paths)-1]
+		for addr, depth := p.addr, p.depth; ; {
+			if d, ok := depths[addr]; ok {
+				if d != depth {
+					return &VerifyError{v.instrs[addr].op, addr, fmt.Sprintf("Inconsistent stack depth: %d, %d", d, depth)}
+				}
+				break
+			}
+			depths[addr] = depth
+			if addr == len(v.prog.code) {
+				if fn {
+					return &VerifyError{0, addr, "Missing return"}
+				}
+				break
+			}
+			in := v.instrs[addr]
+			switch in.op {
+			case opRet:
+				if !fn {
+					return &VerifyError{in.op, addr, "Return outside of function"}
+				}
+			case opTailCall:
+				if !fn {
+					return &VerifyError{in.op, addr, "Tail call outside of function"}
+				}
+			case opGetUpval, opSetUpval, opRefUpval:
+				if !fn {
+					return &VerifyError{in.op, addr, "Upvalue outside of function"}
+				}
+			}
+			effect := opStack[in.op]
+			switch in.op {
+			case opCall, opTailCall:
+				effect.pop += in.args[0]
+			case opClosure:
+				effect.pop += in.args[1]
+			}
+			if depth < effect.pop {
+				return &VerifyError{in.op, addr, fmt.Sprintf("Stack underflow: %d values, %d needed", depth, effect.pop)}
+			}
+			switch in.op {
+			case opGet, opGetCell, opSetI, opSetF:
+				if !validOffset(in.args[0], depth) {
+					return &VerifyError{in.op, addr, fmt.Sprintf("Invalid variable offset: %d", in.args[0])}
+				}
+			case opSet, opSetCell:
+				if !validOffset(in.args[0], depth-1) {
+					return &VerifyError{in.op, addr, fmt.Sprintf("Invalid variable offset: %d", in.args[0])}
+				}
+			}
+			depth += effect.push - effect.pop
+			switch in.op {
+			case opJmp:
+				addr = in.args[0]
+				continue
+			case opJmpF:
+				paths = append(paths, path{in.args[0], depth})
+			}
+			if in.op == opRet || in.op == opTailCall {
+				break
+			}
+			addr = v.next(addr)
+		}
+	}
+	return nil
+}
+
+// next returns the address of the instruction following the one at addr.
+func (v *verifier) next(addr int) int {
+	for addr++; addr < len(v.prog.code); addr++ {
+		if _, ok := v.instrs[addr]; ok {
+			break
+		}
+	}
+	return addr
+}
+
+// validOffset reports whether the offset of a variable refers to one of
+// the depth values of the frame, see interpreter.offsetToAddr.
+func validOffset(offset int, depth int) bool {
+	if offset >= 0 {
+		return offset < depth
+	}
+	return depth+offset > 0
+}
@@ -0,0 +1,104 @@
+package popi
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	prog := assemble(t, `
+	jmp    main
+f:	get    1
+	get    0
+	over
+	over
+	lt
+	jmpf   else
+	swap
+else:	drop
+	ret
+main:	func   f, 2
+	getg   total
+	pushi  3
+	call   2
+	pushf  1.5
+	seti   0, 2
+	drop
+	jmpf   else2
+	nil
+	jmp    end
+else2:	pushi  1
+end:
+`)
+	if err := Verify(prog); err != nil {
+		t.Fatalf("%s: %v", t.Name(), err)
+	}
+}
+
+func TestVerifyErrors(t *testing.T) {
+	tests := []struct {
+		src string
+		msg string
+	}{
+		{"nil\ndrop\ndrop", "Stack underflow: 0 values, 1 needed at address 2 (drop)"},
+		{"nil\ncall 1", "Stack underflow: 1 values, 2 needed at address 1 (call)"},
+		{"ret", "Return outside of function at address 0 (ret)"},
+		{"nil\ntcall 0", "Tail call outside of function at address 1 (tcall)"},
+		{"getu 0", "Upvalue outside of function at address 0 (getu)"},
+		{"nil\nsetu 0", "Upvalue outside of function at address 1 (setu)"},
+		{"nil\nclosure f, 0, 2\nf: ret", "Stack underflow: 1 values, 2 needed at address 1 (closure)"},
+		{"getc 0", "Invalid variable offset: 0 at address 0 (getc)"},
+		{"nil\nsetc 0", "Invalid variable offset: 0 at address 1 (setc)"},
+		{"get 0", "Invalid variable offset: 0 at address 0 (get)"},
+		{"nil\nset 0", "Invalid variable offset: 0 at address 1 (set)"},
+		{"nil\nseti 1, 2", "Invalid variable offset: 1 at address 1 (seti)"},
+		{"jmp 2\nnil", "Invalid address: 2 at address 0 (jmp)"},
+		{"jmp 7", "Invalid address: 7 at address 0 (jmp)"},
+		{"getg 1", "Invalid global: 1 at address 0 (getg)"},
+		{"func 1, 0\nnil", "Function does not start at an instruction at address 1 (func)"},
+		{"jmp main\nf: nil\nmain: func f, 0", "Missing return at address 9"},
+		{"jmp main\nf: drop\nret\nmain: func f, 0", "Stack underflow: 0 values, 1 needed at address 5 (drop)"},
+		// the branches leave different numbers of values
+		{"true\njmpf end\nnil\nend: nil", "Inconsistent stack depth: 1, 0 at address 7 (nil)"},
+		{"loop: nil\njmp loop", "Inconsistent stack depth: 0, 1 at address 0 (nil)"},
+	}
+	for _, test := range tests {
+		prog := assemble(t, test.src)
+		err := Verify(prog)
+		var verr *VerifyError
+		if !errors.As(err, &verr) {
+			t.Fatalf("%s: expected verify error for %q, actual %v", t.Name(), test.src, err)
+		}
+		checkEqualString(t, test.msg, err.Error())
+	}
+
+	code := []struct {
+		code []byte
+		msg  string
+	}{
+		{[]byte{200}, "Unknown opcode: 200 at address 0 (200)"},
+		{[]byte{opNil, opJmp, 0, 0}, "Unexpected end of code at address 1 (jmp)"},
+		{[]byte{opNil, opCall, 0x80, 0x80, 0x80, 0x80, 0x08}, "Invalid operand: 2147483648 at address 1 (call)"},
+		{[]byte{opPushF, 0, 0}, "Invalid constant: 0 at address 0 (pushf)"},
+		{[]byte{opPushS, 1, 0}, "Invalid constant: 1 at address 0 (pushs)"},
+	}
+	for _, test := range code {
+		err := Verify(&Program{code: test.code, consts: []Value{IntValue(1), IntValue(2)}})
+		if err == nil {
+			t.Fatalf("%s: expected verify error for %v", t.Name(), test.code)
+		}
+		checkEqualString(t, test.msg, err.Error())
+	}
+}
+
+func TestDecodeVerify(t *testing.T) {
+	data, err := Encode(assemble(t, "nil\ndrop\ndrop"))
+	if err != nil {
+		t.Fatalf("%s: %v", t.Name(), err)
+	}
+	_, err = Decode(data)
+	var verr *VerifyError
+	if !errors.As(err, &verr) {
+		t.Fatalf("%s: expected verify error, actual %v", t.Name(), err)
+	}
+}